@@ -17,7 +17,7 @@ package main
 
 // NewBlackHole returns a chan which dumps everything it receives
 func NewBlackHole() chan *stat {
-	ch := make(chan *stat, 1)
+	ch := make(chan *stat, statsBuffer)
 	go func() {
 		for {
 			_, open := <-ch
@@ -0,0 +1,120 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// CarrierWave/MiniMagick processing functions a version can name
+const (
+	resizeToFit   = "resize_to_fit"
+	resizeToFill  = "resize_to_fill"
+	resizeToLimit = "resize_to_limit"
+	resizeAndPad  = "resize_and_pad"
+
+	defaultGravity = "Center"
+)
+
+// gravityCrops maps ImageMagick gravity names to the Imagizer crop anchor
+var gravityCrops = map[string]string{
+	"NorthWest": "top,left",
+	"North":     "top",
+	"NorthEast": "top,right",
+	"West":      "left",
+	"Center":    "true",
+	"East":      "right",
+	"SouthWest": "bottom,left",
+	"South":     "bottom",
+	"SouthEast": "bottom,right",
+}
+
+func validateFunctionName(name string) error {
+	switch name {
+	case "", resizeToFit, resizeToFill, resizeToLimit, resizeAndPad:
+		return nil
+	default:
+		return fmt.Errorf("Unknown function_name %q", name)
+	}
+}
+
+// validatePadBackground rejects a resize_and_pad version setting both the
+// background param and the background_color output option, which would both
+// be sent as Imagizer's bgcolor
+func validatePadBackground(props map[string]interface{}) error {
+	functionName, _ := props["function_name"].(string)
+	background, _ := props["background"].(string)
+	output, _ := props["output"].(url.Values)
+	if functionName != resizeAndPad || len(background) == 0 || len(output.Get("bgcolor")) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("Can't be set along with the background param of %s", resizeAndPad)
+}
+
+// gravityCrop returns the Imagizer crop anchor for the gravity param
+func gravityCrop(props map[string]interface{}) (string, error) {
+	gravity := defaultGravity
+	if g, ok := props["gravity"].(string); ok && len(g) > 0 {
+		gravity = g
+	}
+
+	crop, ok := gravityCrops[gravity]
+	if !ok {
+		return "", fmt.Errorf("Unknown gravity %q", gravity)
+	}
+
+	return crop, nil
+}
+
+// processingParams translates a version's CarrierWave processing function,
+// along with its gravity, background and only_shrink_larger options, into the
+// Imagizer params that render the same result:
+//
+//	resize_to_fit   scales to fit within width x height, enlarging small originals
+//	resize_to_limit like resize_to_fit, but never enlarges
+//	resize_to_fill  scales to cover width x height and crops towards gravity
+//	resize_and_pad  scales to fit and pads out to width x height with background
+func processingParams(functionName string, props map[string]interface{}) (url.Values, error) {
+	vals := url.Values{}
+
+	crop, err := gravityCrop(props)
+	if err != nil {
+		return vals, err
+	}
+
+	switch functionName {
+	case "", resizeToFit, resizeToLimit:
+	case resizeToFill:
+		vals.Set("crop", crop)
+	case resizeAndPad:
+		vals.Set("pad", "true")
+		if bg, ok := props["background"].(string); ok && len(bg) > 0 {
+			vals.Set("bgcolor", strings.TrimPrefix(bg, "#"))
+		}
+	default:
+		return vals, validateFunctionName(functionName)
+	}
+
+	shrinkOnly, _ := props["only_shrink_larger"].(bool)
+	if shrinkOnly || functionName == resizeToLimit {
+		vals.Set("upscale", "false")
+	}
+
+	return vals, nil
+}
@@ -0,0 +1,95 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestProcessingParams(t *testing.T) {
+	Convey("Translating CarrierWave processing to Imagizer params", t, func() {
+		cases := []struct {
+			functionName string
+			props        map[string]interface{}
+			expected     string
+		}{
+			{"", map[string]interface{}{}, ""},
+			{resizeToFit, map[string]interface{}{}, ""},
+			{resizeToFit, map[string]interface{}{"only_shrink_larger": true}, "upscale=false"},
+			{resizeToLimit, map[string]interface{}{}, "upscale=false"},
+			{resizeToFill, map[string]interface{}{}, "crop=true"},
+			{resizeToFill, map[string]interface{}{"gravity": "North"}, "crop=top"},
+			{resizeToFill, map[string]interface{}{"gravity": "SouthEast"}, "crop=bottom%2Cright"},
+			{resizeToFill, map[string]interface{}{"only_shrink_larger": true}, "crop=true&upscale=false"},
+			{resizeAndPad, map[string]interface{}{}, "pad=true"},
+			{resizeAndPad, map[string]interface{}{"background": "#000000"}, "bgcolor=000000&pad=true"},
+		}
+
+		for _, c := range cases {
+			Convey(fmt.Sprintf("%s %v", c.functionName, c.props), func() {
+				vals, err := processingParams(c.functionName, c.props)
+				So(err, ShouldBeNil)
+				So(vals.Encode(), ShouldEqual, c.expected)
+			})
+		}
+
+		Convey("Rejects unknown functions and gravities", func() {
+			_, err := processingParams("resize_to_cover", map[string]interface{}{})
+			So(err, ShouldNotBeNil)
+
+			_, err = processingParams(resizeToFill, map[string]interface{}{"gravity": "Up"})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Rejects padding with both a background and a background_color", func() {
+			props := map[string]interface{}{
+				"function_name": resizeAndPad,
+				"background":    "#000000",
+				"output":        OutputOptions{BackgroundColor: "ffffff"}.params(),
+			}
+			So(validatePadBackground(props), ShouldNotBeNil)
+
+			delete(props, "background")
+			So(validatePadBackground(props), ShouldBeNil)
+		})
+	})
+}
+
+func TestImagizerURLProcessing(t *testing.T) {
+	Convey("Imagizer URLs render fill and fit versions differently", t, func() {
+		handler := watermarkTestHandler()
+		info := pictureInfo{userID: 1, ownerID: 1, attachment: "pic.jpg"}
+
+		fill := requestInfo{pictureID: 1, env: "staging", info: info,
+			versionInfo: map[string]interface{}{"function_name": resizeToFill, "width": scalarParam("360"),
+				"height": scalarParam("360")}}
+		fit := requestInfo{pictureID: 1, env: "staging", info: info,
+			versionInfo: map[string]interface{}{"function_name": resizeToFit, "width": scalarParam("640"),
+				"height": scalarParam("960"), "only_shrink_larger": true}}
+
+		u, err := handler.imagizerURL(context.Background(), fill)
+		So(err, ShouldBeNil)
+		So(u.RawQuery, ShouldEqual, "crop=true&height=360&width=360")
+
+		u, err = handler.imagizerURL(context.Background(), fit)
+		So(err, ShouldBeNil)
+		So(u.RawQuery, ShouldEqual, "height=960&upscale=false&width=640")
+	})
+}
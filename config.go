@@ -16,15 +16,21 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 )
 
 type versionProperties map[string]map[string]interface{}
 
+const watermarkedVariantSuffix = "_watermarked"
+
 // BucketNames maps rails environment names to their S3 buckets
 var BucketNames = map[string]string{
 	"development": "snapshots-photos-dev",
@@ -32,34 +38,183 @@ var BucketNames = map[string]string{
 	"production":  "heysnapshots-photos",
 }
 
-// Version contains a single picture version from config
+// Version contains a single picture version from config. A version that
+// extends another inherits everything it doesn't set itself, and params are
+// merged key by key.
 type Version struct {
-	Name         string                 `json:"name"`
-	FunctionName string                 `json:"function_name"`
-	Watermark    bool                   `json:"watermark"`
-	Params       map[string]interface{} `json:"params"`
+	Name               string                 `json:"name"`
+	Extends            string                 `json:"extends,omitempty"`
+	WatermarkedVariant bool                   `json:"watermarked_variant,omitempty"`
+	FunctionName       string                 `json:"function_name"`
+	Watermark          bool                   `json:"watermark"`
+	WatermarkLayers    []WatermarkLayer       `json:"watermark_layers,omitempty"`
+	WatermarkMode      string                 `json:"watermark_mode,omitempty"`
+	WatermarkPolicy    string                 `json:"watermark_policy,omitempty"`
+	Params             map[string]interface{} `json:"params"`
+	RepeatedParams     []string               `json:"repeated_params,omitempty"`
+	OutputOptions
+	watermarkSet bool
+}
+
+// UnmarshalJSON rejects unknown keys, and records whether watermark and the
+// output options were given so a version only overrides those of the one it
+// extends when it sets them explicitly
+func (v *Version) UnmarshalJSON(buf []byte) error {
+	var keys map[string]json.RawMessage
+	err := json.Unmarshal(buf, &keys)
+	if err != nil {
+		return err
+	}
+
+	type plainVersion Version
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	err = dec.Decode((*plainVersion)(v))
+	if err != nil {
+		var name string
+		_ = json.Unmarshal(keys["name"], &name)
+		return fmt.Errorf("Version %s: %v", name, err)
+	}
+
+	_, v.watermarkSet = keys["watermark"]
+	v.OutputOptions.recordSet(keys)
+	return nil
+}
+
+func versionName(name string) string {
+	return strings.TrimLeft(name, ":")
+}
+
+// inherit fills in everything v leaves unset from parent
+func (v Version) inherit(parent Version) Version {
+	if len(v.FunctionName) == 0 {
+		v.FunctionName = parent.FunctionName
+	}
+	if !v.watermarkSet {
+		v.Watermark = parent.Watermark
+		v.watermarkSet = parent.watermarkSet
+	}
+	if len(v.WatermarkLayers) == 0 {
+		v.WatermarkLayers = parent.WatermarkLayers
+	}
+	if len(v.WatermarkMode) == 0 {
+		v.WatermarkMode = parent.WatermarkMode
+	}
+	if len(v.WatermarkPolicy) == 0 {
+		v.WatermarkPolicy = parent.WatermarkPolicy
+	}
+
+	if len(v.RepeatedParams) == 0 {
+		v.RepeatedParams = parent.RepeatedParams
+	}
+
+	params := make(map[string]interface{})
+	for k, val := range parent.Params {
+		params[k] = val
+	}
+	for k, val := range v.Params {
+		params[k] = val
+	}
+	v.Params = params
+	v.OutputOptions = v.OutputOptions.inherit(parent.OutputOptions)
+
+	return v
+}
+
+// properties flattens the version for requests. Params ibex passes to
+// Imagizer are parsed into paramValues, erroring on the first that doesn't
+// parse.
+func (v Version) properties() (map[string]interface{}, error) {
+	mmp := make(map[string]interface{})
+	mmp["function_name"] = v.FunctionName
+	mmp["watermark"] = v.Watermark
+	if len(v.WatermarkMode) > 0 {
+		mmp["watermark_mode"] = v.WatermarkMode
+	}
+	if len(v.WatermarkPolicy) > 0 {
+		mmp["watermark_policy"] = v.WatermarkPolicy
+	}
+	if len(v.WatermarkLayers) > 0 {
+		mmp["watermark_layers"] = v.WatermarkLayers
+	}
+	if len(v.RepeatedParams) > 0 {
+		repeated := make(map[string]bool)
+		for _, key := range v.RepeatedParams {
+			repeated[key] = true
+		}
+		mmp["repeated_params"] = repeated
+	}
+	if output := v.OutputOptions.params(); len(output) > 0 {
+		mmp["output"] = output
+	}
+
+	keys := make([]string, 0, len(v.Params))
+	for key := range v.Params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		param, err := parseVersionParam(key, v.Params[key])
+		if err != nil {
+			return nil, fmt.Errorf("Param %s: %v", key, err)
+		}
+		mmp[key] = param
+	}
+
+	return mmp, nil
 }
 
 // StatsServerConfig contains configuration for the stats server
 type StatsServerConfig struct {
-	Enabled  bool `json:"enabled"`
-	BindPort int  `json:"bind_port"`
+	Enabled    bool   `json:"enabled"`
+	BindPort   int    `json:"bind_port"`
+	AdminToken string `json:"admin_token" secret:"true"`
 }
 
 // Config loads and contains configs from the json file
 type Config struct {
-	DatabaseURL    string            `json:"database_url"`
-	BindPort       int               `json:"bind_port"`
-	Versions       []Version         `json:"versions"`
-	StatsServer    StatsServerConfig `json:"stats_server"`
-	ImagizerHost   string            `json:"imagizer_host"`
-	CDNHost        string            `json:"cdn_host"`
-	BucketName     string            `json:"bucket_name"`
+	DatabaseURL    string             `json:"database_url"`
+	Database       DatabaseConfig     `json:"database"`
+	Source         SourceConfig       `json:"source"`
+	BindPort       int                `json:"bind_port"`
+	Versions       []Version          `json:"versions"`
+	StatsServer    StatsServerConfig  `json:"stats_server"`
+	ImagizerHost   string             `json:"imagizer_host"`
+	CDNHost        string             `json:"cdn_host"`
+	BucketName     string             `json:"bucket_name"`
+	OverlayHost    string             `json:"overlay_host"`
+	OverlaySecret  string             `json:"overlay_secret" secret:"true"`
+	TextWatermarks bool               `json:"text_watermarks"`
+	PictureCache   PictureCacheConfig `json:"picture_cache"`
+	DegradedMode   DegradedModeConfig `json:"degraded_mode"`
+	SoftDelete     SoftDeleteConfig   `json:"soft_delete"`
+	SchemaCheck    SchemaCheckConfig  `json:"schema_check"`
+	Readiness      ReadinessConfig    `json:"readiness"`
+	StatsD         StatsDConfig       `json:"statsd"`
 	versionsByName versionProperties
+	sources        map[string]string
+	format         string
+	mu             sync.RWMutex
 }
 
-// LoadConfig loads the config file from the given path
+// LoadConfig loads the config file from the given path, in the format its
+// extension names. ${VAR} references in its strings are interpolated from the
+// environment, and any field can then be overridden by an IBEX_* environment
+// variable or an IBEX_*_FILE secret.
 func LoadConfig(path string) (*Config, error) {
+	return LoadConfigFormat(path, "")
+}
+
+// LoadConfigFormat loads the config file from the given path in format, or
+// the format its extension names if that's empty. JSON, YAML and TOML configs
+// are all decoded and validated the same way.
+func LoadConfigFormat(path, format string) (*Config, error) {
+	format, err := configFormat(path, format)
+	if err != nil {
+		return nil, err
+	}
+
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -70,17 +225,90 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
-	var config Config
+	buf, err = configToJSON(buf, format)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err = interpolateEnv(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	config := Config{format: format}
 	err = json.Unmarshal(buf, &config)
 	if err != nil {
 		return nil, err
 	}
 
-	config.versionsByName = config.getVersionsByName()
+	var raw map[string]interface{}
+	err = json.Unmarshal(buf, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	config.sources = make(map[string]string)
+	err = applyEnvOverrides(reflect.ValueOf(&config).Elem(), "", raw, config.sources)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	config.versionsByName, err = config.getVersionsByName()
+	if err != nil {
+		return nil, err
+	}
 
 	return &config, nil
 }
 
+// Reload loads and validates the config at path, in the format it was first
+// loaded in, and if it's valid swaps in its versions. Everything else only
+// changes on restart.
+func (c *Config) Reload(path string) error {
+	fresh, err := LoadConfigFormat(path, c.format)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.Versions = fresh.Versions
+	c.versionsByName = fresh.versionsByName
+
+	return nil
+}
+
+// version looks up the resolved properties of the named version
+func (c *Config) version(name string) (map[string]interface{}, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	props, ok := c.versionsByName[name]
+	return props, ok
+}
+
+// Sources lists where each config value came from, sorted by JSON path
+func (c *Config) Sources() []string {
+	paths := make([]string, 0, len(c.sources))
+	for path := range c.sources {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	lines := make([]string, len(paths))
+	for i, path := range paths {
+		lines[i] = fmt.Sprintf("%s from %s", path, c.sources[path])
+	}
+
+	return lines
+}
+
 // BindAddr returns a http.Server compatible addr
 func (c *Config) BindAddr() string {
 	return fmt.Sprintf(":%d", c.BindPort)
@@ -91,30 +319,90 @@ func (c StatsServerConfig) BindAddr() string {
 	return fmt.Sprintf(":%d", c.BindPort)
 }
 
-// VersionNames maps the contained versions' names
+// VersionNames maps the contained versions' names, including generated
+// watermarked variants
 func (c *Config) VersionNames() []string {
-	names := make([]string, len(c.Versions))
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	declared := make(map[string]bool)
+	for _, v := range c.Versions {
+		declared[versionName(v.Name)] = true
+	}
 
-	for i, v := range c.Versions {
-		names[i] = strings.TrimLeft(v.Name, ":")
+	names := make([]string, 0, len(c.Versions))
+	for _, v := range c.Versions {
+		name := versionName(v.Name)
+		names = append(names, name)
+
+		if v.WatermarkedVariant && !declared[name+watermarkedVariantSuffix] {
+			names = append(names, name+watermarkedVariantSuffix)
+		}
 	}
 
 	return names
 }
 
-func (c Config) getVersionsByName() versionProperties {
+// resolveVersion follows the extends chain of v, erroring on unknown parents
+// and cycles
+func resolveVersion(v Version, declared map[string]Version, seen []string) (Version, error) {
+	if len(v.Extends) == 0 {
+		return v, nil
+	}
+
+	name := versionName(v.Name)
+	seen = append(seen, name)
+	for _, s := range seen[:len(seen)-1] {
+		if s == name {
+			return v, fmt.Errorf("Version %s extends itself: %s", name, strings.Join(seen, " -> "))
+		}
+	}
+
+	parent, ok := declared[versionName(v.Extends)]
+	if !ok {
+		return v, fmt.Errorf("Version %s extends unknown version %s", name, versionName(v.Extends))
+	}
+
+	parent, err := resolveVersion(parent, declared, seen)
+	if err != nil {
+		return v, err
+	}
+
+	return v.inherit(parent), nil
+}
+
+// declaredVersions indexes the versions by name
+func (c *Config) declaredVersions() map[string]Version {
+	declared := make(map[string]Version)
+	for _, v := range c.Versions {
+		declared[versionName(v.Name)] = v
+	}
+
+	return declared
+}
+
+func (c *Config) getVersionsByName() (versionProperties, error) {
+	declared := c.declaredVersions()
 	mp := make(versionProperties)
 
 	for _, v := range c.Versions {
-		mmp := make(map[string]interface{})
-		mmp["function_name"] = v.FunctionName
-		mmp["watermark"] = v.Watermark
-		for k, vv := range v.Params {
-			mmp[k] = vv
+		resolved, err := resolveVersion(v, declared, nil)
+		if err != nil {
+			return nil, err
 		}
 
-		mp[strings.TrimLeft(v.Name, ":")] = mmp
+		name := versionName(v.Name)
+		mp[name], err = resolved.properties()
+		if err != nil {
+			return nil, fmt.Errorf("Version %s: %v", name, err)
+		}
+
+		twin := name + watermarkedVariantSuffix
+		if _, ok := declared[twin]; v.WatermarkedVariant && !ok {
+			resolved.Watermark = true
+			mp[twin], _ = resolved.properties()
+		}
 	}
 
-	return mp
+	return mp, nil
 }
@@ -16,6 +16,7 @@
 package main
 
 import (
+	"encoding/json"
 	"sort"
 	"testing"
 
@@ -26,7 +27,7 @@ func TestLoading(t *testing.T) {
 	Convey("Loads config from disk", t, func() {
 		config := load()
 
-		So(config.BindPort, ShouldEqual, 192048)
+		So(config.BindPort, ShouldEqual, 19248)
 		So(len(config.Versions), ShouldEqual, 3)
 		So(config.BucketName, ShouldEqual, "test-bucket")
 	})
@@ -37,7 +38,7 @@ func TestBindAddr(t *testing.T) {
 		config := load()
 
 		addr := config.BindAddr()
-		So(addr, ShouldEqual, ":192048")
+		So(addr, ShouldEqual, ":19248")
 	})
 }
 
@@ -58,7 +59,8 @@ func TestGetVersionsByName(t *testing.T) {
 	Convey("Extacting versions into a map", t, func() {
 		config := load()
 
-		byName := config.getVersionsByName()
+		byName, err := config.getVersionsByName()
+		So(err, ShouldBeNil)
 
 		keys := make([]string, len(byName))
 		i := 0
@@ -74,3 +76,62 @@ func TestGetVersionsByName(t *testing.T) {
 		So(keys, ShouldResemble, names)
 	})
 }
+
+func TestVersionInheritance(t *testing.T) {
+	Convey("Versions extending other versions", t, func() {
+		var versions []Version
+		err := json.Unmarshal([]byte(`[
+			{"name": ":large", "function_name": "resize_to_fit", "watermarked_variant": true,
+			 "params": {"width": 640, "height": 960}},
+			{"name": ":large_marked", "extends": ":large", "watermark": true, "params": {"width": 800}},
+			{"name": ":large_marked_2x", "extends": "large_marked", "params": {"height": 1920}}
+		]`), &versions)
+		So(err, ShouldBeNil)
+
+		config := Config{Versions: versions}
+		byName, err := config.getVersionsByName()
+		So(err, ShouldBeNil)
+
+		So(byName["large_marked"]["function_name"], ShouldEqual, "resize_to_fit")
+		So(byName["large_marked"]["watermark"], ShouldBeTrue)
+		So(byName["large_marked"]["width"], ShouldEqual, scalarParam("800"))
+		So(byName["large_marked"]["height"], ShouldEqual, scalarParam("960"))
+
+		So(byName["large_marked_2x"]["watermark"], ShouldBeTrue)
+		So(byName["large_marked_2x"]["width"], ShouldEqual, scalarParam("800"))
+		So(byName["large_marked_2x"]["height"], ShouldEqual, scalarParam("1920"))
+
+		Convey("Generates watermarked variants", func() {
+			So(byName["large"]["watermark"], ShouldBeFalse)
+			So(byName["large_watermarked"]["watermark"], ShouldBeTrue)
+			So(byName["large_watermarked"]["width"], ShouldEqual, scalarParam("640"))
+			So(config.VersionNames(), ShouldContain, "large_watermarked")
+		})
+
+		Convey("Detects cycles", func() {
+			config.Versions[0].Extends = "large_marked_2x"
+			_, err := config.getVersionsByName()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "large -> large_marked_2x -> large_marked -> large")
+		})
+
+		Convey("Rejects unknown parents", func() {
+			config.Versions[0].Extends = "huge"
+			_, err := config.getVersionsByName()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Rejects params it can't use", func() {
+			for _, params := range []map[string]interface{}{
+				{"height": []interface{}{[]interface{}{1.0}}},
+				{"watermark_mode": "tiled"},
+				{"gravity": 5.0},
+			} {
+				config.Versions[0].Params = params
+				_, err := config.getVersionsByName()
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldStartWith, "Version large: Param ")
+			}
+		})
+	})
+}
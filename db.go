@@ -20,28 +20,155 @@ import (
 	"database/sql"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
 )
 
 const (
-	maxIdleConns    = 0
-	maxOpenConns    = 30
-	maxConnLifetime = 10 * time.Second
-
-	querySQL = `
-SELECT pictures.user_id, pictures.attachment, events.owner_id, photographer_infos.id,
-  photographer_infos.picture, watermarks.id, watermarks.disabled, watermarks.logo,
-  watermarks.alpha, watermarks.scale, watermarks.offset, watermarks.position
+	defaultMaxOpenConns      = 30
+	defaultMaxIdleConns      = 10
+	defaultConnMaxLifetime   = 300
+	defaultQueryTimeoutMilli = 2000
+
+	// prepareRetryInterval is how often preparing the queries is retried
+	// when the database was down at startup
+	prepareRetryInterval = 5 * time.Second
+
+	// watermarkTextColumns only exist once the migration adding text
+	// watermarks has run, so they're only selected with text_watermarks set.
+	// NULLs stand in for them otherwise.
+	watermarkTextColumns = `watermarks.text, watermarks.text_font, watermarks.text_size,
+  watermarks.text_color, watermarks.text_alpha, watermarks.text_position`
+	watermarkNoTextColumns = `NULL, NULL, NULL, NULL, NULL, NULL`
+
+	// The picture queries are formatted with whether the picture is deleted,
+	// the condition for live watermarks and the watermark text columns, see
+	// SoftDeleteConfig.queries
+	pictureColumns = `
+SELECT pictures.user_id, pictures.attachment, pictures.event_id, events.owner_id,
+  photographer_infos.id, photographer_infos.picture, watermarks.id, watermarks.disabled,
+  watermarks.logo, watermarks.alpha, watermarks.scale, watermarks.offset, watermarks.position,
+  %[3]s, %[1]s, pictures.id`
+
+	pictureJoins = `
 FROM pictures
-LEFT JOIN watermarks ON watermarks.id = pictures.watermark_id
+LEFT JOIN watermarks ON watermarks.id = pictures.watermark_id%[2]s
 LEFT JOIN photographer_infos ON photographer_infos.user_id = pictures.user_id
-JOIN events ON events.id = pictures.event_id
+JOIN events ON events.id = pictures.event_id`
+
+	querySQL = pictureColumns + pictureJoins + `
 WHERE pictures.id = $1;`
+
+	batchQuerySQL = pictureColumns + pictureJoins + `
+WHERE pictures.id = ANY($1);`
+
+	// neighboursSQL loads the pictures of the same event closest by id
+	neighboursSQL = pictureColumns + pictureJoins + `
+WHERE pictures.event_id = (SELECT event_id FROM pictures WHERE id = $1)
+  AND pictures.id <> $1
+ORDER BY abs(pictures.id - $1)
+LIMIT $2;`
+
+	ownerMarkSQL = `
+SELECT photographer_infos.id, photographer_infos.picture, watermarks.id, watermarks.disabled,
+  watermarks.logo, watermarks.alpha, watermarks.scale, watermarks.offset, watermarks.position,
+  %[2]s
+FROM photographer_infos
+LEFT JOIN watermarks ON watermarks.photographer_info_id = photographer_infos.id
+  AND watermarks."default"%[1]s
+WHERE photographer_infos.user_id = $1
+ORDER BY watermarks.updated_at DESC NULLS LAST, watermarks.id DESC
+LIMIT 1;`
 )
 
+// DatabaseConfig contains configuration for the database connection pool.
+// Zero values use the defaults; a negative max_idle_conns keeps no idle
+// connections and a negative conn_max_lifetime_seconds reuses them forever.
+type DatabaseConfig struct {
+	MaxOpenConns           int      `json:"max_open_conns"`
+	MaxIdleConns           int      `json:"max_idle_conns"`
+	ConnMaxLifetimeSeconds int      `json:"conn_max_lifetime_seconds"`
+	QueryTimeoutMillis     int      `json:"query_timeout_ms"`
+	Replicas               []string `json:"replicas"`
+	ReplicaSelection       string   `json:"replica_selection"`
+	MaxReplicaLagMillis    int      `json:"max_replica_lag_ms"`
+	ReplicaCheckSeconds    int      `json:"replica_check_seconds"`
+}
+
+func (c DatabaseConfig) maxOpenConns() int {
+	if c.MaxOpenConns == 0 {
+		return defaultMaxOpenConns
+	}
+
+	return c.MaxOpenConns
+}
+
+func (c DatabaseConfig) maxIdleConns() int {
+	if c.MaxIdleConns == 0 && c.maxOpenConns() < defaultMaxIdleConns {
+		return c.maxOpenConns()
+	} else if c.MaxIdleConns == 0 {
+		return defaultMaxIdleConns
+	}
+
+	return c.MaxIdleConns
+}
+
+func (c DatabaseConfig) connMaxLifetime() time.Duration {
+	if c.ConnMaxLifetimeSeconds == 0 {
+		return defaultConnMaxLifetime * time.Second
+	}
+
+	return time.Duration(c.ConnMaxLifetimeSeconds) * time.Second
+}
+
+func (c DatabaseConfig) queryTimeout() time.Duration {
+	if c.QueryTimeoutMillis == 0 {
+		return defaultQueryTimeoutMilli * time.Millisecond
+	}
+
+	return time.Duration(c.QueryTimeoutMillis) * time.Millisecond
+}
+
+func (c DatabaseConfig) validate(errs *ConfigErrors, path string) {
+	if c.MaxOpenConns < 0 {
+		errs.add(path+".max_open_conns", "must not be negative, got %d", c.MaxOpenConns)
+	}
+	if c.maxIdleConns() > c.maxOpenConns() {
+		errs.add(path+".max_idle_conns", "must not exceed max_open_conns (%d), got %d",
+			c.maxOpenConns(), c.maxIdleConns())
+	}
+	if c.QueryTimeoutMillis < 0 {
+		errs.add(path+".query_timeout_ms", "must not be negative, got %d", c.QueryTimeoutMillis)
+	}
+
+	for i, url := range c.Replicas {
+		validateDSN(errs, fmt.Sprintf("%s.replicas[%d]", path, i), url)
+	}
+	errs.check(path+".replica_selection", validateReplicaSelection(c.ReplicaSelection))
+	if c.MaxReplicaLagMillis < 0 {
+		errs.add(path+".max_replica_lag_ms", "must not be negative, got %d", c.MaxReplicaLagMillis)
+	}
+	if c.ReplicaCheckSeconds < 0 {
+		errs.add(path+".replica_check_seconds", "must not be negative, got %d", c.ReplicaCheckSeconds)
+	}
+}
+
+// PoolStats is the state of the database connection pool, from sql.DBStats
+type PoolStats struct {
+	MaxOpen           int   `json:"max_open"`
+	Open              int   `json:"open"`
+	InUse             int   `json:"in_use"`
+	Idle              int   `json:"idle"`
+	WaitCount         int64 `json:"wait_count"`
+	WaitDurationMilli int64 `json:"wait_duration_ms"`
+	MaxIdleClosed     int64 `json:"max_idle_closed"`
+	MaxLifetimeClosed int64 `json:"max_lifetime_closed"`
+}
+
 type noRowsErr struct {
 	message string
 }
@@ -75,6 +202,22 @@ func newNullInt64(i int64) sql.NullInt64 {
 	return sql.NullInt64{Valid: true, Int64: i}
 }
 
+func nullStringOr(ns sql.NullString, def string) string {
+	if ns.Valid {
+		return ns.String
+	}
+
+	return def
+}
+
+func nullInt64Or(ni sql.NullInt64, def int64) int64 {
+	if ni.Valid {
+		return ni.Int64
+	}
+
+	return def
+}
+
 type watermark struct {
 	id       sql.NullInt64
 	disabled sql.NullBool
@@ -83,13 +226,35 @@ type watermark struct {
 	scale    sql.NullInt64
 	offset   sql.NullInt64
 	position sql.NullString
+
+	text         sql.NullString
+	textFont     sql.NullString
+	textSize     sql.NullInt64
+	textColor    sql.NullString
+	textAlpha    sql.NullInt64
+	textPosition sql.NullString
+}
+
+// scanDest returns the Scan destinations for the watermark columns, in the
+// order they're selected by the queries
+func (wm *watermark) scanDest() []interface{} {
+	return []interface{}{
+		&wm.id, &wm.disabled, &wm.logo, &wm.alpha, &wm.scale, &wm.offset, &wm.position,
+		&wm.text, &wm.textFont, &wm.textSize, &wm.textColor, &wm.textAlpha, &wm.textPosition,
+	}
 }
 
 func (wm *watermark) mungePosition() {
-	if wm.position.Valid {
-		matched := regexp.MustCompile(`[- ]`).ReplaceAllString(wm.position.String, "")
+	mungeYAMLList(&wm.position)
+	mungeYAMLList(&wm.textPosition)
+}
+
+// mungeYAMLList turns a Rails-serialized YAML list into a comma-separated string
+func mungeYAMLList(ns *sql.NullString) {
+	if ns.Valid {
+		matched := regexp.MustCompile(`[- ]`).ReplaceAllString(ns.String, "")
 		matched = regexp.MustCompile(`\n`).ReplaceAllString(strings.TrimSpace(matched), ",")
-		wm.position.String = matched
+		ns.String = matched
 	}
 }
 
@@ -97,71 +262,343 @@ func (wm *watermark) mungePosition() {
 type pictureInfo struct {
 	userID             int
 	attachment         string
+	eventID            int
 	ownerID            int
 	photographerInfoID sql.NullInt64
 	oldMark            sql.NullString
 	mark               watermark
+	deleted            bool
+	stale              bool
+}
+
+// scanDest returns the Scan destinations for the picture columns, in the
+// order they're selected by pictureColumns, with the picture's id last
+func (info *pictureInfo) scanDest(id *int) []interface{} {
+	dest := []interface{}{
+		&info.userID, &info.attachment, &info.eventID, &info.ownerID,
+		&info.photographerInfoID, &info.oldMark,
+	}
+	dest = append(dest, info.mark.scanDest()...)
+
+	return append(dest, &info.deleted, id)
+}
+
+// ownerMark is the event owner's default watermark, used to brand guest uploads
+type ownerMark struct {
+	photographerInfoID sql.NullInt64
+	oldMark            sql.NullString
+	mark               watermark
+}
+
+// queries are the SQL run by the DB, built for the soft-delete columns
+type queries struct {
+	picture    string
+	batch      string
+	neighbours string
+	ownerMark  string
+}
+
+func (q queries) all() []string {
+	return []string{q.picture, q.batch, q.neighbours, q.ownerMark}
 }
 
 // DB encapsulates a DB connection + queries
 type DB struct {
-	conn *sql.DB
+	nextReplica      uint64
+	primaryFallbacks uint64
+	conn             *sql.DB
+	stmtsMu          sync.RWMutex
+	stmts            map[string]*sql.Stmt
+	queries          queries
+	columns          map[string][]string
+	replicas         []*replica
+	replicaSelection string
+	cache            *pictureCache
+	health           *dbHealth
+	neighbours       int
+	neighbourLoads   *prefetchPool
+	queryTimeout     time.Duration
 }
 
-// NewDB connects to the database and loads the queries from YeSQL.
+// openPool opens a connection pool to the database at url
+func openPool(url string, c DatabaseConfig) (*sql.DB, error) {
+	conn, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetMaxOpenConns(c.maxOpenConns())
+	conn.SetMaxIdleConns(c.maxIdleConns())
+	conn.SetConnMaxLifetime(c.connMaxLifetime())
+
+	return conn, nil
+}
+
+// NewDB connects to the database and its read replicas
 func NewDB(c *Config) (*DB, error) {
-	conn, err := sql.Open("postgres", c.DatabaseURL)
+	conn, err := openPool(c.DatabaseURL, c.Database)
 	if err != nil {
 		return nil, err
 	}
-	conn.SetMaxIdleConns(maxIdleConns)
-	conn.SetMaxOpenConns(maxOpenConns)
-	conn.SetConnMaxLifetime(maxConnLifetime)
 
 	db := DB{
-		conn: conn,
+		conn:             conn,
+		queries:          c.SoftDelete.queries(c.TextWatermarks),
+		replicaSelection: c.Database.ReplicaSelection,
+		queryTimeout:     c.Database.queryTimeout(),
+	}
+	for _, url := range c.Database.Replicas {
+		r, err := newReplica(url, c.Database)
+		if err != nil {
+			return nil, err
+		}
+		db.replicas = append(db.replicas, r)
+	}
+	if c.SchemaCheck.onMismatch() != schemaCheckOff {
+		db.columns = requiredColumns(c.SoftDelete, c.TextWatermarks)
+	}
+	if c.PictureCache.Enabled {
+		db.cache = newPictureCache(c.PictureCache)
+		if len(db.replicas) > 0 {
+			db.cache.primaryWindow = c.Database.maxReplicaLag() + c.Database.replicaCheckInterval()
+		}
+		db.neighbours = c.PictureCache.PrefetchNeighbours
+		if db.neighbours > 0 {
+			db.neighbourLoads = newPrefetchPool(prefetchWorkers, prefetchQueue)
+		}
+	}
+	if c.DegradedMode.Enabled {
+		db.health = newDBHealth(c.DegradedMode)
 	}
 
 	return &db, nil
 }
 
+// prepareQueries prepares the queries on conn, so requests only send their
+// arguments
+func prepareQueries(ctx context.Context, conn *sql.DB, q queries) (map[string]*sql.Stmt, error) {
+	stmts := make(map[string]*sql.Stmt)
+	for _, query := range q.all() {
+		stmt, err := conn.PrepareContext(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		stmts[query] = stmt
+	}
+
+	return stmts, nil
+}
+
+// Prepare prepares the queries on the primary, unless they already are.
+// Until they are, queries run unprepared. Replicas prepare theirs when their
+// first health check passes.
+func (db *DB) Prepare(ctx context.Context) error {
+	if db.isPrepared() {
+		return nil
+	}
+
+	stmts, err := prepareQueries(ctx, db.conn, db.queries)
+	if err != nil {
+		return err
+	}
+
+	db.stmtsMu.Lock()
+	defer db.stmtsMu.Unlock()
+
+	if db.stmts != nil {
+		for _, stmt := range stmts {
+			_ = stmt.Close()
+		}
+		return nil
+	}
+
+	db.stmts = stmts
+	return nil
+}
+
+func (db *DB) isPrepared() bool {
+	return db.primaryStmts() != nil
+}
+
+func (db *DB) primaryStmts() map[string]*sql.Stmt {
+	db.stmtsMu.RLock()
+	defer db.stmtsMu.RUnlock()
+
+	return db.stmts
+}
+
+// prepareRetrying retries Prepare every interval until it works, so a
+// database that was down at startup gets prepared queries once it's back.
+// It waits while degraded, as probeHealth prepares them on recovery.
+func (db *DB) prepareRetrying(interval time.Duration, logger ILogger) {
+	for !db.isPrepared() {
+		time.Sleep(interval)
+		if db.health.isDegraded() {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), db.queryTimeout)
+		err := db.Prepare(ctx)
+		cancel()
+
+		if err != nil {
+			logger.Debug("Still can't prepare the queries: %v", err)
+			continue
+		}
+
+		logger.Info("Prepared the queries")
+	}
+}
+
+// queryRow runs query with ctx, through its prepared statement if there is
+// one. The query is cancelled on the server when ctx is done.
+func queryRow(ctx context.Context, conn *sql.DB, stmts map[string]*sql.Stmt, query string, args ...interface{}) *sql.Row {
+	if stmt, ok := stmts[query]; ok {
+		return stmt.QueryRowContext(ctx, args...)
+	}
+
+	return conn.QueryRowContext(ctx, query, args...)
+}
+
+// queryRow runs query on the primary
+func (db *DB) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return queryRow(ctx, db.conn, db.primaryStmts(), query, args...)
+}
+
+// queryRows is queryRow for queries returning many rows
+func queryRows(ctx context.Context, conn *sql.DB, stmts map[string]*sql.Stmt, query string, args ...interface{}) (*sql.Rows, error) {
+	if stmt, ok := stmts[query]; ok {
+		return stmt.QueryContext(ctx, args...)
+	}
+
+	return conn.QueryContext(ctx, query, args...)
+}
+
+// poolStats reports the state of a connection pool
+func poolStats(conn *sql.DB) PoolStats {
+	st := conn.Stats()
+
+	return PoolStats{
+		MaxOpen:           st.MaxOpenConnections,
+		Open:              st.OpenConnections,
+		InUse:             st.InUse,
+		Idle:              st.Idle,
+		WaitCount:         st.WaitCount,
+		WaitDurationMilli: int64(st.WaitDuration / time.Millisecond),
+		MaxIdleClosed:     st.MaxIdleClosed,
+		MaxLifetimeClosed: st.MaxLifetimeClosed,
+	}
+}
+
+// poolStats reports the state of the primary's connection pool
+func (db *DB) poolStats() PoolStats {
+	return poolStats(db.conn)
+}
+
+// loadPictureInfo loads the info of the picture with the given id, from the
+// cache when it's enabled. Pictures that aren't found are cached too, and
+// loading a picture can prefetch its neighbours in the same event, once per
+// event at a time. While the database is failing, stale cached info is
+// served instead.
 func (db *DB) loadPictureInfo(ctx context.Context, id int) (pictureInfo, error) {
-	ctxTimeout, cancel := context.WithTimeout(ctx, 2*time.Second)
+	logger := ctx.Value("logger").(ILogger)
+
+	if db.cache == nil {
+		if db.health.isDegraded() {
+			return pictureInfo{}, errDegraded
+		}
+
+		info, err := db.queryPictureInfo(ctx, id, false)
+		db.recordHealth(ctx, logger, err)
+		return info, err
+	}
+
+	if entry, ok := db.cache.get(id); ok {
+		return entry.info, entry.err
+	}
+
+	if db.health.isDegraded() {
+		return db.staleOr(id, errDegraded)
+	}
+
+	generation := db.cache.currentGeneration()
+	info, err := db.queryPictureInfo(ctx, id, db.cache.readFromPrimary(id))
+	switch err.(type) {
+	case nil, noRowsErr:
+		db.cache.put(id, generation, info, err)
+	}
+
+	if db.recordHealth(ctx, logger, err) {
+		return db.staleOr(id, err)
+	}
+
+	if err == nil && db.neighbours > 0 {
+		db.neighbourLoads.submit(strconv.Itoa(info.eventID), func() { db.loadNeighbours(logger, id) })
+	}
+
+	return info, err
+}
+
+// queryPictureInfo queries the picture's info from a replica, or from the
+// primary when fromPrimary is set
+func (db *DB) queryPictureInfo(ctx context.Context, id int, fromPrimary bool) (pictureInfo, error) {
+	ctxTimeout, cancel := context.WithTimeout(ctx, db.queryTimeout)
 	defer cancel()
 
 	logger := ctxTimeout.Value("logger").(ILogger)
 
-	outChan := make(chan pictureInfo)
-	errChan := make(chan error)
-
-	go func() {
-		info := pictureInfo{}
-
-		err := db.conn.QueryRow(querySQL, id).Scan(
-			&info.userID, &info.attachment, &info.ownerID, &info.photographerInfoID,
-			&info.oldMark, &info.mark.id, &info.mark.disabled, &info.mark.logo,
-			&info.mark.alpha, &info.mark.scale, &info.mark.offset, &info.mark.position,
-		)
-
-		switch {
-		case err == sql.ErrNoRows:
-			err = newNoRowsError("No picture found with id %d", id)
-			fallthrough
-		case err != nil:
-			errChan <- err
-		default:
-			info.mark.mungePosition()
-			logger.Debug("Picture Info for %d: %+v", id, info)
-			outChan <- info
-		}
-	}()
+	info := pictureInfo{}
+	var rowID int
+	var err error
+	if fromPrimary {
+		err = db.queryRow(ctxTimeout, db.queries.picture, id).Scan(info.scanDest(&rowID)...)
+	} else {
+		err = db.scanRow(ctxTimeout, db.queries.picture, []interface{}{id}, info.scanDest(&rowID)...)
+	}
 
-	select {
-	case info := <-outChan:
-		return info, nil
-	case err := <-errChan:
-		return pictureInfo{}, err
-	case <-ctxTimeout.Done():
+	switch {
+	case ctxTimeout.Err() != nil:
 		return pictureInfo{}, fmt.Errorf("context timeout: %+v", ctxTimeout.Err())
+	case err == sql.ErrNoRows:
+		return pictureInfo{}, newNoRowsError("No picture found with id %d", id)
+	case err != nil:
+		return pictureInfo{}, err
+	}
+
+	info.mark.mungePosition()
+	logger.Debug("Picture Info for %d: %+v", id, info)
+	return info, nil
+}
+
+// loadOwnerMark loads the default watermark of the user with the given id. An
+// owner without a photographer profile gets an empty mark rather than an error.
+// Owner marks aren't cached, so there's nothing to serve while degraded.
+func (db *DB) loadOwnerMark(ctx context.Context, ownerID int) (ownerMark, error) {
+	if db.health.isDegraded() {
+		return ownerMark{}, errDegraded
 	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, db.queryTimeout)
+	defer cancel()
+
+	logger := ctxTimeout.Value("logger").(ILogger)
+
+	om := ownerMark{}
+	dest := []interface{}{&om.photographerInfoID, &om.oldMark}
+
+	err := db.scanRow(ctxTimeout, db.queries.ownerMark, []interface{}{ownerID}, append(dest, om.mark.scanDest()...)...)
+
+	switch {
+	case ctxTimeout.Err() != nil:
+		return ownerMark{}, fmt.Errorf("context timeout: %+v", ctxTimeout.Err())
+	case err == sql.ErrNoRows:
+		logger.Debug("No photographer info for owner %d", ownerID)
+		return ownerMark{}, nil
+	case err != nil:
+		db.recordHealth(ctx, logger, err)
+		return ownerMark{}, err
+	}
+
+	om.mark.mungePosition()
+	logger.Debug("Owner mark for %d: %+v", ownerID, om)
+	return om, nil
 }
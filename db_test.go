@@ -18,7 +18,12 @@ package main
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"runtime"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -31,7 +36,7 @@ func TestConnectionAndQuery(t *testing.T) {
 			watermarkID         sql.NullInt64
 		}{}
 
-		rows, err := db.conn.Query("select * from pictures limit 1")
+		rows, err := db.conn.Query("select id, user_id, event_id, attachment, watermark_id from pictures limit 1")
 		if err != nil {
 			t.Errorf("Error querying database: %v", err)
 			t.FailNow()
@@ -70,11 +75,190 @@ func TestLoadPictureInfo(t *testing.T) {
 		info, err := db.loadPictureInfo(ctx, 1)
 		So(err, ShouldBeNil)
 
+		So(info.eventID, ShouldEqual, 1)
 		So(info.ownerID, ShouldEqual, 1)
 		So(info.mark.id.Valid, ShouldBeFalse)
+
+		info, err = db.loadPictureInfo(ctx, 3)
+		So(err, ShouldBeNil)
+
+		So(info.mark.logo.Valid, ShouldBeFalse)
+		So(info.mark.text.String, ShouldEqual, "Photo by Test Photographer")
+		So(info.mark.textSize.Int64, ShouldEqual, 32)
+		So(info.mark.textPosition.String, ShouldEqual, "bottom,right")
+		So(info.deleted, ShouldBeFalse)
+
+		info, err = db.loadPictureInfo(ctx, 4)
+		So(err, ShouldBeNil)
+		So(info.deleted, ShouldBeTrue)
+
+		info, err = db.loadPictureInfo(ctx, 5)
+		So(err, ShouldBeNil)
+		So(info.deleted, ShouldBeTrue)
+
+		info, err = db.loadPictureInfo(ctx, 6)
+		So(err, ShouldBeNil)
+		So(info.deleted, ShouldBeFalse)
+		So(info.mark.id.Valid, ShouldBeFalse)
 	}))
 }
 
+func TestLoadOwnerMark(t *testing.T) {
+	Convey("LoadOwnerMark", t, withTestFixtures(func(config *Config, db *DB, logger testLogger) {
+		ctx := context.Background()
+		ctx = context.WithValue(ctx, "logger", logger)
+
+		// Watermark 8 is a default mark too, but updated longer ago
+		om, err := db.loadOwnerMark(ctx, 1)
+		So(err, ShouldBeNil)
+		So(om.photographerInfoID.Int64, ShouldEqual, 1)
+		So(om.mark.id.Int64, ShouldEqual, 1)
+		So(om.mark.position.String, ShouldEqual, "bottom,left")
+
+		om, err = db.loadOwnerMark(ctx, 42)
+		So(err, ShouldBeNil)
+		So(om.photographerInfoID.Valid, ShouldBeFalse)
+		So(om.mark.id.Valid, ShouldBeFalse)
+	}))
+}
+
+// hangingDriver is a database driver whose queries never return until
+// they're cancelled, standing in for a stuck Postgres
+type hangingDriver struct{}
+
+type hangingConn struct{}
+
+type hangingStmt struct{}
+
+func (hangingDriver) Open(string) (driver.Conn, error) { return hangingConn{}, nil }
+
+func (hangingConn) Prepare(string) (driver.Stmt, error) { return hangingStmt{}, nil }
+func (hangingConn) Close() error                        { return nil }
+func (hangingConn) Begin() (driver.Tx, error)           { return nil, errors.New("unsupported") }
+
+func (hangingStmt) Close() error  { return nil }
+func (hangingStmt) NumInput() int { return -1 }
+func (hangingStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("unsupported")
+}
+func (hangingStmt) Query([]driver.Value) (driver.Rows, error) {
+	return nil, errors.New("unsupported")
+}
+func (hangingStmt) QueryContext(ctx context.Context, _ []driver.NamedValue) (driver.Rows, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// downDriver is a hangingDriver that can't prepare statements or answer
+// pings while databaseDown is set
+type downDriver struct{}
+
+type downConn struct{ hangingConn }
+
+var databaseDown int32
+
+func (downDriver) Open(string) (driver.Conn, error) { return downConn{}, nil }
+
+func (c downConn) Prepare(query string) (driver.Stmt, error) {
+	if atomic.LoadInt32(&databaseDown) == 1 {
+		return nil, errors.New("connection refused")
+	}
+
+	return c.hangingConn.Prepare(query)
+}
+
+func (downConn) Ping(context.Context) error {
+	if atomic.LoadInt32(&databaseDown) == 1 {
+		return errors.New("connection refused")
+	}
+
+	return nil
+}
+
+func init() {
+	sql.Register("ibex-hanging", hangingDriver{})
+	sql.Register("ibex-down", downDriver{})
+}
+
+func TestQueryTimeoutsDontLeak(t *testing.T) {
+	Convey("Timed out queries", t, func() {
+		conn, err := sql.Open("ibex-hanging", "")
+		So(err, ShouldBeNil)
+		db := &DB{conn: conn, queries: SoftDeleteConfig{}.queries(false), queryTimeout: time.Second}
+		So(db.Prepare(context.Background()), ShouldBeNil)
+
+		logger := testLogger{}
+		ctx := context.WithValue(context.Background(), "logger", logger)
+
+		before := runtime.NumGoroutine()
+
+		for i := 0; i < 20; i++ {
+			timeout, cancel := context.WithTimeout(ctx, time.Millisecond)
+			_, err = db.loadPictureInfo(timeout, 1)
+			So(err.Error(), ShouldContainSubstring, "context timeout")
+
+			_, err = db.loadOwnerMark(timeout, 1)
+			So(err.Error(), ShouldContainSubstring, "context timeout")
+			cancel()
+		}
+
+		// Cancelled queries may take a moment to return
+		for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		So(runtime.NumGoroutine(), ShouldBeLessThanOrEqualTo, before)
+	})
+}
+
+func TestPrepareRetrying(t *testing.T) {
+	Convey("Preparing the queries once the database is back", t, func() {
+		conn, err := sql.Open("ibex-down", "")
+		So(err, ShouldBeNil)
+		db := &DB{conn: conn, queries: SoftDeleteConfig{}.queries(false), queryTimeout: time.Second}
+
+		atomic.StoreInt32(&databaseDown, 1)
+		So(db.Prepare(context.Background()), ShouldNotBeNil)
+		So(db.isPrepared(), ShouldBeFalse)
+
+		done := make(chan struct{})
+		go func() {
+			db.prepareRetrying(time.Millisecond, testLogger{})
+			close(done)
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+		So(db.isPrepared(), ShouldBeFalse)
+
+		atomic.StoreInt32(&databaseDown, 0)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+		So(db.isPrepared(), ShouldBeTrue)
+		So(db.primaryStmts(), ShouldHaveLength, len(db.queries.all()))
+	})
+}
+
+func TestDatabaseConfig(t *testing.T) {
+	Convey("Database pool config", t, func() {
+		var c DatabaseConfig
+		So(c.maxOpenConns(), ShouldEqual, defaultMaxOpenConns)
+		So(c.maxIdleConns(), ShouldEqual, defaultMaxIdleConns)
+		So(c.queryTimeout(), ShouldEqual, 2*time.Second)
+		So(DatabaseConfig{MaxOpenConns: 4}.maxIdleConns(), ShouldEqual, 4)
+
+		var errs ConfigErrors
+		c.validate(&errs, "$.database")
+		So(errs, ShouldBeEmpty)
+
+		c = DatabaseConfig{MaxOpenConns: 5, MaxIdleConns: 8, QueryTimeoutMillis: -1}
+		c.validate(&errs, "$.database")
+		So(len(errs), ShouldEqual, 2)
+		So(errs[0].Path, ShouldEqual, "$.database.max_idle_conns")
+		So(errs[1].Path, ShouldEqual, "$.database.query_timeout_ms")
+	})
+}
+
 func TestNewNullString(t *testing.T) {
 	Convey("NewNullString output", t, func() {
 		cases := map[string]sql.NullString{
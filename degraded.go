@@ -0,0 +1,423 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	healthPath = "/healthz"
+
+	degradedHeader        = "X-Ibex-Degraded"
+	degradedStaleMetadata = "stale-metadata"
+	degradedCachedRender  = "cached-render"
+
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+
+	defaultFailureThreshold = 3
+	defaultProbeSeconds     = 5
+	defaultMaxStaleSeconds  = 3600
+	defaultRenderCacheMB    = 64
+	defaultMaxRenderKB      = 1024
+)
+
+var errDegraded = errors.New("The database is unavailable")
+
+// DegradedModeConfig contains configuration for serving from caches while
+// the database is failing
+type DegradedModeConfig struct {
+	Enabled          bool `json:"enabled"`
+	FailureThreshold int  `json:"failure_threshold"`
+	ProbeSeconds     int  `json:"probe_seconds"`
+	MaxStaleSeconds  int  `json:"max_stale_seconds"`
+	RenderCacheMB    int  `json:"render_cache_mb"`
+	MaxRenderKB      int  `json:"max_render_kb"`
+}
+
+func (c DegradedModeConfig) failureThreshold() int {
+	if c.FailureThreshold == 0 {
+		return defaultFailureThreshold
+	}
+
+	return c.FailureThreshold
+}
+
+func (c DegradedModeConfig) probeInterval() time.Duration {
+	if c.ProbeSeconds == 0 {
+		return defaultProbeSeconds * time.Second
+	}
+
+	return time.Duration(c.ProbeSeconds) * time.Second
+}
+
+func (c DegradedModeConfig) maxStale() time.Duration {
+	if c.MaxStaleSeconds == 0 {
+		return defaultMaxStaleSeconds * time.Second
+	}
+
+	return time.Duration(c.MaxStaleSeconds) * time.Second
+}
+
+func (c DegradedModeConfig) renderCacheBytes() int {
+	if c.RenderCacheMB == 0 {
+		return defaultRenderCacheMB << 20
+	}
+
+	return c.RenderCacheMB << 20
+}
+
+func (c DegradedModeConfig) maxRenderBytes() int {
+	if c.MaxRenderKB == 0 {
+		return defaultMaxRenderKB << 10
+	}
+
+	return c.MaxRenderKB << 10
+}
+
+func (c DegradedModeConfig) validate(errs *ConfigErrors, path string) {
+	if !c.Enabled {
+		return
+	}
+
+	for key, val := range map[string]int{
+		"failure_threshold": c.FailureThreshold,
+		"probe_seconds":     c.ProbeSeconds,
+		"max_stale_seconds": c.MaxStaleSeconds,
+		"render_cache_mb":   c.RenderCacheMB,
+		"max_render_kb":     c.MaxRenderKB,
+	} {
+		if val < 0 {
+			errs.add(path+"."+key, "must not be negative, got %d", val)
+		}
+	}
+}
+
+// HealthStatus reports whether ibex is serving normally or degraded
+type HealthStatus struct {
+	Status        string     `json:"status"`
+	DegradedSince *time.Time `json:"degraded_since,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// dbHealth tracks database failures, entering degraded mode after threshold
+// failures in a row and leaving it on the next success
+type dbHealth struct {
+	mu        sync.RWMutex
+	threshold int
+	maxStale  time.Duration
+	failures  int
+	degraded  bool
+	since     time.Time
+	lastErr   string
+}
+
+func newDBHealth(c DegradedModeConfig) *dbHealth {
+	return &dbHealth{threshold: c.failureThreshold(), maxStale: c.maxStale()}
+}
+
+func (h *dbHealth) isDegraded() bool {
+	if h == nil {
+		return false
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.degraded
+}
+
+// failure records a failed query, returning true if it started degraded mode
+func (h *dbHealth) failure(err error) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.failures++
+	h.lastErr = redactCredentials(err.Error())
+	if h.degraded || h.failures < h.threshold {
+		return false
+	}
+
+	h.degraded = true
+	h.since = time.Now()
+	return true
+}
+
+// enter starts degraded mode straight away, for failures no query recovers
+// from on its own
+func (h *dbHealth) enter(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastErr = redactCredentials(err.Error())
+	if !h.degraded {
+		h.degraded = true
+		h.since = time.Now()
+	}
+}
+
+// success records a working query, returning true if it ended degraded mode
+func (h *dbHealth) success() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	recovered := h.degraded
+	h.failures = 0
+	h.degraded = false
+	h.lastErr = ""
+
+	return recovered
+}
+
+func (h *dbHealth) status() HealthStatus {
+	if h == nil {
+		return HealthStatus{Status: healthOK}
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if !h.degraded {
+		return HealthStatus{Status: healthOK}
+	}
+
+	since := h.since
+	return HealthStatus{Status: healthDegraded, DegradedSince: &since, LastError: h.lastErr}
+}
+
+// recordHealth notes whether a query worked, returning true if err is a
+// failure. Not finding a picture is a working query, and a query the request
+// itself gave up on says nothing about the database.
+func (db *DB) recordHealth(ctx context.Context, logger ILogger, err error) bool {
+	_, notFound := err.(noRowsErr)
+
+	switch {
+	case err == nil || notFound:
+		if db.health != nil && db.health.success() {
+			logger.Info("The database recovered, leaving degraded mode")
+		}
+		return false
+	case ctx.Err() != nil:
+		return true
+	default:
+		if db.health != nil && db.health.failure(err) {
+			logger.Warn("The database is failing, entering degraded mode: %v", err)
+		}
+		return true
+	}
+}
+
+// staleOr returns the stale cached info for the picture, or err when there
+// isn't any
+func (db *DB) staleOr(id int, err error) (pictureInfo, error) {
+	if db.cache == nil || db.health == nil {
+		return pictureInfo{}, err
+	}
+
+	entry, ok := db.cache.getStale(id, db.health.maxStale)
+	if !ok || entry.err != nil {
+		return pictureInfo{}, err
+	}
+
+	entry.info.stale = true
+	return entry.info, nil
+}
+
+// probeHealth pings the database every interval while it's degraded, and
+// checks its schema again, so ibex leaves degraded mode once it's back even
+// if no requests need it. The queries are prepared on recovery if they
+// couldn't be before.
+func (db *DB) probeHealth(interval time.Duration, logger ILogger) {
+	for {
+		time.Sleep(interval)
+		if !db.health.isDegraded() {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), db.queryTimeout)
+		err := db.conn.PingContext(ctx)
+		if err == nil {
+			err = db.checkSchema(ctx)
+		}
+		cancel()
+
+		if err != nil {
+			logger.Debug("Database still failing: %v", err)
+			db.health.failure(err)
+			continue
+		}
+
+		if !db.health.success() {
+			continue
+		}
+		logger.Info("The database recovered, leaving degraded mode")
+
+		ctx, cancel = context.WithTimeout(context.Background(), db.queryTimeout)
+		if err = db.Prepare(ctx); err != nil {
+			logger.Warn("Couldn't prepare the queries after recovering: %v", err)
+		}
+		cancel()
+	}
+}
+
+// healthReporter is a PictureInfoSource that knows whether it's degraded
+type healthReporter interface {
+	healthStatus() HealthStatus
+}
+
+func (db *DB) healthStatus() HealthStatus {
+	return db.health.status()
+}
+
+// healthHandler reports whether ibex is serving normally or degraded. It's
+// 200 either way, since a degraded ibex still serves what it can.
+type healthHandler struct {
+	source PictureInfoSource
+	logger ILogger
+}
+
+func (h healthHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Body != nil {
+		h.logger.CloseQuietly(req.Body)
+	}
+
+	status := HealthStatus{Status: healthOK}
+	if reporter, ok := h.source.(healthReporter); ok {
+		status = reporter.healthStatus()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// renderCache keeps recent Imagizer renders, keyed by requestInfo.renderKey,
+// to serve while the database is down. It evicts the least recently used once
+// the renders add up to maxBytes. The keys are indexed by picture too, so
+// every version of a picture can be dropped at once.
+type renderCache struct {
+	mu        sync.Mutex
+	maxBytes  int
+	maxEntry  int
+	used      int
+	order     *list.List
+	entries   map[string]*list.Element
+	byPicture map[int]map[string]bool
+}
+
+type renderEntry struct {
+	key       string
+	pictureID int
+	body      []byte
+}
+
+func newRenderCache(c DegradedModeConfig) *renderCache {
+	return &renderCache{
+		maxBytes:  c.renderCacheBytes(),
+		maxEntry:  c.maxRenderBytes(),
+		order:     list.New(),
+		entries:   make(map[string]*list.Element),
+		byPicture: make(map[int]map[string]bool),
+	}
+}
+
+func (c *renderCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.order.MoveToFront(el)
+	return el.Value.(renderEntry).body, true
+}
+
+func (c *renderCache) put(key string, pictureID int, body []byte) {
+	if len(body) > c.maxEntry || len(body) > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+
+	for c.used+len(body) > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+
+	c.entries[key] = c.order.PushFront(renderEntry{key, pictureID, body})
+	c.used += len(body)
+
+	keys, ok := c.byPicture[pictureID]
+	if !ok {
+		keys = make(map[string]bool)
+		c.byPicture[pictureID] = keys
+	}
+	keys[key] = true
+}
+
+// dropPicture forgets every render of the picture, e.g. once it's deleted
+func (c *renderCache) dropPicture(pictureID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.byPicture[pictureID] {
+		c.remove(c.entries[key])
+	}
+}
+
+func (c *renderCache) remove(el *list.Element) {
+	entry := el.Value.(renderEntry)
+	c.order.Remove(el)
+	delete(c.entries, entry.key)
+	c.used -= len(entry.body)
+
+	keys := c.byPicture[entry.pictureID]
+	delete(keys, entry.key)
+	if len(keys) == 0 {
+		delete(c.byPicture, entry.pictureID)
+	}
+}
+
+// cappedBuffer buffers writes until they pass max bytes, then gives up, so a
+// render can be captured for the cache while it's streamed to the client
+type cappedBuffer struct {
+	buf      []byte
+	max      int
+	overflow bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if !b.overflow && len(b.buf)+len(p) <= b.max {
+		b.buf = append(b.buf, p...)
+	} else {
+		b.overflow = true
+		b.buf = nil
+	}
+
+	return len(p), nil
+}
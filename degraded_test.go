@@ -0,0 +1,200 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDBHealth(t *testing.T) {
+	Convey("Tracking database health", t, func() {
+		health := newDBHealth(DegradedModeConfig{FailureThreshold: 2})
+		So(health.status().Status, ShouldEqual, healthOK)
+
+		So(health.failure(errors.New("connection refused")), ShouldBeFalse)
+		So(health.isDegraded(), ShouldBeFalse)
+		So(health.failure(errors.New("connection refused")), ShouldBeTrue)
+		So(health.isDegraded(), ShouldBeTrue)
+
+		status := health.status()
+		So(status.Status, ShouldEqual, healthDegraded)
+		So(status.LastError, ShouldEqual, "connection refused")
+		So(status.DegradedSince, ShouldNotBeNil)
+
+		So(health.success(), ShouldBeTrue)
+		So(health.isDegraded(), ShouldBeFalse)
+		So(health.success(), ShouldBeFalse)
+	})
+}
+
+func TestProbeHealth(t *testing.T) {
+	Convey("Probing the database while degraded", t, func() {
+		conn, err := sql.Open("ibex-down", "")
+		So(err, ShouldBeNil)
+		db := &DB{
+			conn:         conn,
+			queries:      SoftDeleteConfig{}.queries(false),
+			health:       newDBHealth(DegradedModeConfig{}),
+			queryTimeout: time.Second,
+		}
+		db.health.enter(errors.New("connection refused"))
+
+		go db.probeHealth(5*time.Millisecond, testLogger{})
+
+		Convey("Prepares the queries once it recovers", func() {
+			deadline := time.Now().Add(time.Second)
+			for db.health.isDegraded() || !db.isPrepared() {
+				if time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			So(db.health.isDegraded(), ShouldBeFalse)
+			So(db.isPrepared(), ShouldBeTrue)
+		})
+	})
+}
+
+func TestDegradedPictureInfo(t *testing.T) {
+	Convey("Loading picture info while the database fails", t, func() {
+		conn, _ := sql.Open("ibex-failing", "")
+		db := &DB{
+			conn:         conn,
+			cache:        newPictureCache(PictureCacheConfig{TTLSeconds: 1}),
+			health:       newDBHealth(DegradedModeConfig{FailureThreshold: 2}),
+			queryTimeout: time.Second,
+		}
+		ctx := context.WithValue(context.Background(), "logger", testLogger{})
+
+		now := time.Now()
+		db.cache.now = func() time.Time { return now }
+		db.cache.put(1, db.cache.currentGeneration(), pictureInfo{attachment: "pic.jpg"}, nil)
+		now = now.Add(time.Minute)
+
+		info, err := db.loadPictureInfo(ctx, 1)
+		So(err, ShouldBeNil)
+		So(info.stale, ShouldBeTrue)
+		So(info.attachment, ShouldEqual, "pic.jpg")
+		So(db.health.isDegraded(), ShouldBeFalse)
+
+		_, err = db.loadPictureInfo(ctx, 2)
+		So(err.Error(), ShouldEqual, "connection reset")
+		So(db.health.isDegraded(), ShouldBeTrue)
+
+		_, err = db.loadPictureInfo(ctx, 2)
+		So(err, ShouldEqual, errDegraded)
+
+		info, err = db.loadPictureInfo(ctx, 1)
+		So(err, ShouldBeNil)
+		So(info.stale, ShouldBeTrue)
+
+		Convey("Until it's too stale", func() {
+			now = now.Add(2 * time.Hour)
+			_, err = db.loadPictureInfo(ctx, 1)
+			So(err, ShouldEqual, errDegraded)
+		})
+	})
+}
+
+func TestRenderCache(t *testing.T) {
+	Convey("Caching renders", t, func() {
+		renders := newRenderCache(DegradedModeConfig{})
+		renders.maxBytes, renders.maxEntry = 10, 6
+
+		renders.put("/a", 1, []byte("aaaa"))
+		renders.put("/b", 2, []byte("bbbb"))
+		renders.put("/big", 3, []byte("bigbigbig"))
+		_, ok := renders.get("/big")
+		So(ok, ShouldBeFalse)
+
+		renders.get("/a")
+		renders.put("/c", 3, []byte("cccc"))
+
+		_, ok = renders.get("/b")
+		So(ok, ShouldBeFalse)
+		body, ok := renders.get("/a")
+		So(ok, ShouldBeTrue)
+		So(string(body), ShouldEqual, "aaaa")
+		So(renders.used, ShouldEqual, 8)
+		So(renders.byPicture, ShouldNotContainKey, 2)
+
+		Convey("Drops every render of a picture", func() {
+			renders.put("/a2", 1, []byte("aa"))
+			renders.dropPicture(1)
+
+			_, ok := renders.get("/a")
+			So(ok, ShouldBeFalse)
+			_, ok = renders.get("/a2")
+			So(ok, ShouldBeFalse)
+			_, ok = renders.get("/c")
+			So(ok, ShouldBeTrue)
+			So(renders.used, ShouldEqual, 4)
+		})
+
+		Convey("Capturing renders stops past the limit", func() {
+			buf := &cappedBuffer{max: 4}
+			_, _ = buf.Write([]byte("ab"))
+			So(buf.overflow, ShouldBeFalse)
+			_, _ = buf.Write([]byte("cde"))
+			So(buf.overflow, ShouldBeTrue)
+			So(buf.buf, ShouldBeNil)
+		})
+	})
+}
+
+func TestDegradedHandlers(t *testing.T) {
+	Convey("Serving while degraded", t, func() {
+		conn, _ := sql.Open("ibex-failing", "")
+		db := &DB{conn: conn, health: newDBHealth(DegradedModeConfig{FailureThreshold: 1}), queryTimeout: time.Second}
+
+		imagizerHost, _ := url.Parse("http://imagizer.test")
+		handler := imagizerHandler{imagizerHost: imagizerHost, config: load(), source: db, logger: testLogger{},
+			statsChan: NewBlackHole(), responseTimeout: time.Second, renders: newRenderCache(DegradedModeConfig{})}
+
+		handler.renders.put("staging/1/thumb", 1, []byte("cached jpeg"))
+
+		for _, path := range []string{
+			"/uploads/staging/picture/attachment/1/thumb",
+			"/uploads/staging/picture/attachment/1/thumb/anything",
+		} {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			So(w.Code, ShouldEqual, 200)
+			So(w.Body.String(), ShouldEqual, "cached jpeg")
+			So(w.Header().Get(degradedHeader), ShouldEqual, degradedCachedRender)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/uploads/staging/picture/attachment/2/thumb", nil))
+		So(w.Code, ShouldEqual, 503)
+
+		w = httptest.NewRecorder()
+		healthHandler{db, testLogger{}}.ServeHTTP(w, httptest.NewRequest("GET", healthPath, nil))
+		So(w.Code, ShouldEqual, 200)
+		So(w.Body.String(), ShouldContainSubstring, `"status":"degraded"`)
+		So(strings.Contains(w.Body.String(), "connection reset"), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,201 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	envPrefix     = "IBEX_"
+	envFileSuffix = "_FILE"
+
+	sourceDefault = "default"
+	sourceConfig  = "config"
+)
+
+var interpolationMatcher = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// interpolateEnv replaces ${VAR} and ${VAR:-default} in the string values of
+// a config, once it's been converted to JSON, with the environment's values.
+// Values are substituted after decoding, so they need no escaping whatever
+// format the config was written in.
+func interpolateEnv(buf []byte) ([]byte, error) {
+	var generic interface{}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	generic = interpolateValue(generic, &missing)
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("Undefined variables in config: %s", strings.Join(missing, ", "))
+	}
+
+	return json.Marshal(generic)
+}
+
+// interpolateValue interpolates every string in val, collecting the names of
+// undefined variables in missing
+func interpolateValue(val interface{}, missing *[]string) interface{} {
+	switch val := val.(type) {
+	case string:
+		return interpolationMatcher.ReplaceAllStringFunc(val, func(match string) string {
+			groups := interpolationMatcher.FindStringSubmatch(match)
+
+			env, ok := os.LookupEnv(groups[1])
+			if !ok {
+				if !strings.Contains(match, ":-") {
+					*missing = append(*missing, groups[1])
+					return match
+				}
+				env = groups[2]
+			}
+
+			return env
+		})
+	case map[string]interface{}:
+		for k, v := range val {
+			val[k] = interpolateValue(v, missing)
+		}
+	case []interface{}:
+		for i, v := range val {
+			val[i] = interpolateValue(v, missing)
+		}
+	}
+
+	return val
+}
+
+// envName returns the environment variable that overrides the config path,
+// e.g. IBEX_STATS_SERVER_BIND_PORT for stats_server.bind_port
+func envName(path string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(path, ".", "_", -1))
+}
+
+// lookupEnvOverride finds the override for a config path, either directly in
+// the environment or in the file named by the _FILE variant
+func lookupEnvOverride(path string) (val, source string, err error) {
+	name := envName(path)
+	fileName := name + envFileSuffix
+
+	val, hasVal := os.LookupEnv(name)
+	file, hasFile := os.LookupEnv(fileName)
+
+	switch {
+	case hasVal && hasFile:
+		return "", "", fmt.Errorf("Both %s and %s are set", name, fileName)
+	case hasVal:
+		return val, "env " + name, nil
+	case hasFile:
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", "", fmt.Errorf("Reading %s: %v", fileName, err)
+		}
+
+		return strings.TrimRight(string(buf), "\r\n"), "file " + file, nil
+	default:
+		return "", "", nil
+	}
+}
+
+func setFromString(v reflect.Value, val string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(val)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	default:
+		return json.Unmarshal([]byte(val), v.Addr().Interface())
+	}
+
+	return nil
+}
+
+// applyEnvOverrides walks the json-tagged fields of v, replacing any that
+// have an environment override and recording where each value came from.
+// raw is the decoded config file, used to tell config values from defaults.
+func applyEnvOverrides(v reflect.Value, prefix string, raw map[string]interface{}, sources map[string]string) error {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if len(field.PkgPath) > 0 || len(name) == 0 || name == "-" {
+			continue
+		}
+
+		path := name
+		if len(prefix) > 0 {
+			path = prefix + "." + name
+		}
+
+		if field.Type.Kind() == reflect.Struct {
+			sub, _ := raw[name].(map[string]interface{})
+			if err := applyEnvOverrides(v.Field(i), path, sub, sources); err != nil {
+				return err
+			}
+			continue
+		}
+
+		sources[path] = sourceDefault
+		if _, ok := raw[name]; ok {
+			sources[path] = sourceConfig
+		}
+
+		val, source, err := lookupEnvOverride(path)
+		if err != nil {
+			return err
+		}
+		if len(source) == 0 {
+			continue
+		}
+
+		if err = setFromString(v.Field(i), val); err != nil {
+			return fmt.Errorf("Invalid value for %s from %s: %v", path, source, err)
+		}
+		sources[path] = source
+	}
+
+	return nil
+}
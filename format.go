@@ -0,0 +1,148 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	formatJSON = "json"
+	formatYAML = "yaml"
+	formatTOML = "toml"
+)
+
+var formatsByExtension = map[string]string{
+	".json": formatJSON,
+	".yaml": formatYAML,
+	".yml":  formatYAML,
+	".toml": formatTOML,
+}
+
+// configFormat picks the format of the config at path, either the given
+// override or the one matching its extension. Paths with any other extension
+// are read as JSON, as they always were.
+func configFormat(path, override string) (string, error) {
+	if len(override) > 0 {
+		switch override {
+		case formatJSON, formatYAML, formatTOML:
+			return override, nil
+		default:
+			return "", fmt.Errorf("Unknown config format %q", override)
+		}
+	}
+
+	format, ok := formatsByExtension[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		return formatJSON, nil
+	}
+
+	return format, nil
+}
+
+// configToJSON converts a YAML or TOML config into JSON, so every format is
+// decoded and validated the same way
+func configToJSON(buf []byte, format string) ([]byte, error) {
+	var generic interface{}
+
+	switch format {
+	case formatJSON:
+		return buf, nil
+	case formatYAML:
+		if err := yaml.Unmarshal(buf, &generic); err != nil {
+			return nil, err
+		}
+	case formatTOML:
+		var table map[string]interface{}
+		if err := toml.Unmarshal(buf, &table); err != nil {
+			return nil, err
+		}
+		generic = table
+	default:
+		return nil, fmt.Errorf("Unknown config format %q", format)
+	}
+
+	return json.Marshal(generic)
+}
+
+// normalizeNumbers turns the json.Numbers of a generic config into ints or
+// floats, so they're encoded as numbers in other formats
+func normalizeNumbers(val interface{}) interface{} {
+	switch val := val.(type) {
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return i
+		}
+		f, _ := val.Float64()
+		return f
+	case map[string]interface{}:
+		for k, v := range val {
+			val[k] = normalizeNumbers(v)
+		}
+	case []interface{}:
+		for i, v := range val {
+			val[i] = normalizeNumbers(v)
+		}
+	}
+
+	return val
+}
+
+// ConvertConfig rewrites the config in buf from one format into another. The
+// file is converted as written, so ${VAR} references are kept.
+func ConvertConfig(buf []byte, from, to string) ([]byte, error) {
+	buf, err := configToJSON(buf, from)
+	if err != nil {
+		return nil, err
+	}
+
+	var generic interface{}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if err = dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	generic = normalizeNumbers(generic)
+
+	var out bytes.Buffer
+	switch to {
+	case formatJSON:
+		enc := json.NewEncoder(&out)
+		enc.SetIndent("", "    ")
+		err = enc.Encode(generic)
+	case formatYAML:
+		enc := yaml.NewEncoder(&out)
+		enc.SetIndent(2)
+		err = enc.Encode(generic)
+	case formatTOML:
+		err = toml.NewEncoder(&out).Encode(generic)
+	default:
+		err = fmt.Errorf("Unknown config format %q", to)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
@@ -0,0 +1,117 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConfigFormat(t *testing.T) {
+	Convey("Detecting the config format", t, func() {
+		for file, expected := range map[string]string{
+			"ibex.json": formatJSON,
+			"ibex.yaml": formatYAML,
+			"ibex.YML":  formatYAML,
+			"ibex.toml": formatTOML,
+		} {
+			format, err := configFormat(file, "")
+			So(err, ShouldBeNil)
+			So(format, ShouldEqual, expected)
+		}
+
+		format, err := configFormat("ibex.conf", "toml")
+		So(err, ShouldBeNil)
+		So(format, ShouldEqual, formatTOML)
+
+		for _, file := range []string{"ibex.conf", "/etc/ibex"} {
+			format, err = configFormat(file, "")
+			So(err, ShouldBeNil)
+			So(format, ShouldEqual, formatJSON)
+		}
+
+		_, err = configFormat("ibex.json", "ini")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	Convey("Loading YAML and TOML configs", t, func() {
+		expected := load()
+
+		for _, file := range []string{"config.yaml", "config.toml"} {
+			config, err := LoadConfig(path.Join("test_resources", file))
+			So(err, ShouldBeNil)
+			So(config.DatabaseURL, ShouldEqual, expected.DatabaseURL)
+			So(config.BindPort, ShouldEqual, expected.BindPort)
+			So(config.StatsServer, ShouldResemble, expected.StatsServer)
+			So(config.Versions, ShouldResemble, expected.Versions)
+			So(config.versionsByName, ShouldResemble, expected.versionsByName)
+		}
+
+		Convey("Validates them the same way", func() {
+			_, err := LoadConfigFormat(path.Join("test_resources", "config.json"), formatYAML)
+			So(err, ShouldBeNil)
+
+			bad, err := ioutil.TempFile("", "ibex-*.yaml")
+			So(err, ShouldBeNil)
+			defer os.Remove(bad.Name())
+			_, _ = bad.WriteString("bind_port: 0\nversions:\n  - name: thumb\n    colour: red\n")
+			_ = bad.Close()
+
+			_, err = LoadConfig(bad.Name())
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Version thumb")
+		})
+	})
+}
+
+func TestConvertConfig(t *testing.T) {
+	Convey("Converting a JSON config", t, func() {
+		buf, err := ioutil.ReadFile(path.Join("test_resources", "config.json"))
+		So(err, ShouldBeNil)
+
+		for _, format := range []string{formatYAML, formatTOML} {
+			out, err := ConvertConfig(buf, formatJSON, format)
+			So(err, ShouldBeNil)
+
+			converted, err := ioutil.TempFile("", "ibex-*."+format)
+			So(err, ShouldBeNil)
+			defer os.Remove(converted.Name())
+			_, _ = converted.Write(out)
+			_ = converted.Close()
+
+			config, err := LoadConfig(converted.Name())
+			So(err, ShouldBeNil)
+			So(config.Versions, ShouldResemble, load().Versions)
+		}
+
+		Convey("Keeps ${VAR} references", func() {
+			out, err := ConvertConfig([]byte(`{"database_url": "${IBEX_TEST_DB}"}`), formatJSON, formatYAML)
+			So(err, ShouldBeNil)
+			So(string(out), ShouldContainSubstring, "${IBEX_TEST_DB}")
+		})
+
+		Convey("Rejects unknown formats", func() {
+			_, err := ConvertConfig(buf, formatJSON, "ini")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -122,25 +122,25 @@ func (l ibexLogger) GetPrefix(withCaller bool) string {
 
 // Info logs a statement to the log
 func (l ibexLogger) Info(format string, vars ...interface{}) {
-	l.infoLogger.Printf(fmt.Sprintf("[INFO]  %s %s", l.GetPrefix(false), format), vars...)
+	l.infoLogger.Print(logLine("[INFO] ", l.GetPrefix(false), format, vars))
 }
 
 // Warn logs a warning statement to stderr
 func (l ibexLogger) Warn(format string, vars ...interface{}) {
-	l.errLogger.Printf(fmt.Sprintf("[WARN]  %s %s", l.GetPrefix(false), format), vars...)
+	l.errLogger.Print(logLine("[WARN] ", l.GetPrefix(false), format, vars))
 
 }
 
 // Debug logs a statement to the log if verbosity is turned on
 func (l ibexLogger) Debug(format string, vars ...interface{}) {
 	if l.debug {
-		l.debugLogger.Printf(fmt.Sprintf("[DEBUG] %s %s", l.GetPrefix(true), format), vars...)
+		l.debugLogger.Print(logLine("[DEBUG]", l.GetPrefix(true), format, vars))
 	}
 }
 
 // Fatal logs a statement to the log and then panics
 func (l ibexLogger) Fatal(format string, vars ...interface{}) {
-	l.errLogger.Fatalf(fmt.Sprintf("[FATAL] %s %s", l.GetPrefix(true), format), vars...)
+	l.errLogger.Fatal(logLine("[FATAL]", l.GetPrefix(true), format, vars))
 }
 
 func (l ibexLogger) HandleErr(err interface{}) {
@@ -163,6 +163,11 @@ func (l ibexLogger) CloseQuietly(handle io.Closer) {
 	l.HandleErr(err)
 }
 
+// logLine formats a log statement, redacting any credentials in it
+func logLine(level, prefix, format string, vars []interface{}) string {
+	return redactCredentials(fmt.Sprintf(fmt.Sprintf("%s %s %s", level, prefix, format), vars...))
+}
+
 func getCaller() (string, error) {
 	_, file, line, ok := runtime.Caller(runtimeCallerFrame)
 
@@ -16,7 +16,13 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 const (
@@ -24,8 +30,12 @@ const (
 )
 
 func main() {
-	var debugLogEnabled bool
+	var debugLogEnabled, checkConfig bool
+	var format, convertTo string
 	flag.BoolVar(&debugLogEnabled, "debug", false, "enable verbose debug logging")
+	flag.BoolVar(&checkConfig, "check-config", false, "validate the config file and exit")
+	flag.StringVar(&format, "config-format", "", "config file format: json, yaml or toml (default from extension)")
+	flag.StringVar(&convertTo, "convert-config", "", "print the config file converted to json, yaml or toml and exit")
 	flag.Parse()
 
 	var configFile string
@@ -34,23 +44,128 @@ func main() {
 		configFile = defaultConfigFilePath
 	}
 
+	if len(convertTo) > 0 {
+		os.Exit(runConfigConvert(configFile, format, convertTo))
+	}
+
+	if checkConfig {
+		os.Exit(runConfigCheck(configFile, format))
+	}
+
 	logger := newLogger(debugLogEnabled)
 	logger.Debug("Debug logging enabled")
 
-	config, err := LoadConfig(configFile)
+	config, err := LoadConfigFormat(configFile, format)
 	logger.HandleErr(err)
 
 	logger.Info("Loaded config from %s", configFile)
 	logger.Info("Found %d versions: %s", len(config.Versions), config.VersionNames())
+	for _, source := range config.Sources() {
+		logger.Debug("Config %s", source)
+	}
+
+	go reloadOnHangup(config, configFile, logger)
+
+	source, err := newPictureInfoSource(config)
+	logger.HandleErr(err)
+	logger.Info("Loading picture info from %s", config.Source.kind())
+
+	db, _ := source.(*DB)
+	if db != nil {
+		logger.HandleErr(db.startupSchemaCheck(config, logger))
+		if !db.health.isDegraded() {
+			ctx, cancel := context.WithTimeout(context.Background(), db.queryTimeout)
+			err = db.Prepare(ctx)
+			cancel()
+			if err != nil {
+				logger.Warn("Couldn't prepare the queries, running them unprepared until they can be: %v", err)
+			}
+		}
+		if !db.isPrepared() {
+			go db.prepareRetrying(prepareRetryInterval, logger)
+		}
+		if db.cache != nil {
+			go db.listenForInvalidations(config, logger)
+		}
+		if db.health != nil {
+			go db.probeHealth(config.DegradedMode.probeInterval(), logger)
+		}
+		if len(db.replicas) > 0 {
+			go db.checkReplicas(config.Database.replicaCheckInterval(), config.Database.maxReplicaLag(), logger)
+		}
+	}
 
-	var statsChan chan *stat
+	metrics := NewMetrics()
+	ready := newReadiness(config, source, db)
+	var sinks []StatsSink
 	if config.StatsServer.Enabled {
 		stats := NewStats(logger)
-		go stats.Start(config)
-		statsChan = stats.statsChan
-	} else {
-		statsChan = NewBlackHole()
+		go stats.Start(config, db, metrics, ready)
+		sinks = append(sinks, stats)
+	}
+	if config.StatsD.Enabled {
+		statsd, err := newStatsdSink(config.StatsD, logger)
+		logger.HandleErr(err)
+		go statsd.flushEvery(config.StatsD.flushInterval())
+		sinks = append(sinks, statsd)
+	}
+
+	Start(config, source, logger, newStatsChan(sinks...), metrics, ready)
+}
+
+// runConfigCheck validates the config file for deploy pipelines, returning
+// the process exit code
+func runConfigCheck(configFile, format string) int {
+	_, err := LoadConfigFormat(configFile, format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, redactCredentials(err.Error()))
+		return 1
+	}
+
+	fmt.Printf("%s is valid\n", configFile)
+	return 0
+}
+
+// runConfigConvert prints the config file converted into another format,
+// returning the process exit code
+func runConfigConvert(configFile, from, to string) int {
+	from, err := configFormat(configFile, from)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	buf, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
 
-	Start(config, logger, statsChan)
+	out, err := ConvertConfig(buf, from, to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, redactCredentials(err.Error()))
+		return 1
+	}
+
+	os.Stdout.Write(out)
+	return 0
+}
+
+// reloadOnHangup reloads the config whenever the process receives SIGHUP,
+// keeping the current one if the new file doesn't validate
+func reloadOnHangup(config *Config, configFile string, logger ILogger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		err := config.Reload(configFile)
+		if err != nil {
+			logger.Warn("Not reloading %s: %v", configFile, err)
+			continue
+		}
+
+		names := config.VersionNames()
+		logger.Info("Reloaded config from %s", configFile)
+		logger.Info("Found %d versions: %s", len(names), names)
+	}
 }
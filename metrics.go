@@ -0,0 +1,331 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	// maxSeries caps the label combinations of a metric, since env and
+	// version come from request paths. Later combinations are counted under
+	// overflowLabel.
+	maxSeries     = 1000
+	overflowLabel = "overflow"
+	unknownLabel  = "unknown"
+
+	stageDB       = "db"
+	stageImagizer = "imagizer"
+	stageCopy     = "copy"
+)
+
+// latencyBuckets are the upper bounds of the latency histograms, in seconds
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// series is one label combination of a metric
+type series struct {
+	labels []string
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+// metricVec is a counter or histogram partitioned by labels
+type metricVec struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: "counter", labels: labels, series: make(map[string]*series)}
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *metricVec {
+	v := newCounterVec(name, help, labels...)
+	v.kind = "histogram"
+	v.buckets = buckets
+
+	return v
+}
+
+// with returns the series for the label values. The caller holds v.mu.
+func (v *metricVec) with(values []string) *series {
+	key := strings.Join(values, "\xff")
+	if s, ok := v.series[key]; ok {
+		return s
+	}
+
+	if len(v.series) >= maxSeries {
+		values = make([]string, len(values))
+		for i := range values {
+			values[i] = overflowLabel
+		}
+		key = strings.Join(values, "\xff")
+		if s, ok := v.series[key]; ok {
+			return s
+		}
+	}
+
+	s := &series{labels: values, counts: make([]uint64, len(v.buckets))}
+	v.series[key] = s
+	return s
+}
+
+func (v *metricVec) add(delta float64, values ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.with(values).value += delta
+}
+
+func (v *metricVec) observe(val float64, values ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	s := v.with(values)
+	s.value += val
+	s.count++
+	for i, bound := range v.buckets {
+		if val <= bound {
+			s.counts[i]++
+		}
+	}
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i])))
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[0], extra[1]))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(val float64) string {
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
+
+// write writes the metric in the Prometheus text format, its series sorted
+// by label values
+func (v *metricVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := v.series[key]
+		if v.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.labels), formatValue(s.value))
+			continue
+		}
+
+		for i, bound := range v.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name,
+				formatLabels(v.labels, s.labels, "le", formatValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, formatLabels(v.labels, s.labels), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, formatLabels(v.labels, s.labels), s.count)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, val float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatValue(val))
+}
+
+func writeCounter(w io.Writer, name, help string, val float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %s\n", name, help, name, name, formatValue(val))
+}
+
+// Metrics collects request metrics for Prometheus. Its methods are safe to
+// call from any goroutine, and on a nil Metrics they do nothing.
+type Metrics struct {
+	inFlight         int64
+	imagizerInFlight int64
+
+	requests *metricVec
+	bytes    *metricVec
+	duration *metricVec
+	stages   *metricVec
+}
+
+// NewMetrics instantiates and returns a new metrics collector
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: newCounterVec("ibex_requests_total",
+			"Image requests by version, env and status code.", "version", "env", "status"),
+		bytes: newCounterVec("ibex_served_bytes_total",
+			"Image bytes served by version.", "version"),
+		duration: newHistogramVec("ibex_request_duration_seconds",
+			"Time to answer image requests.", latencyBuckets),
+		stages: newHistogramVec("ibex_stage_duration_seconds",
+			"Time spent in each stage of image requests: db lookup, imagizer response and body copy.",
+			latencyBuckets, "stage"),
+	}
+}
+
+// requestStarted counts a request in flight, returning a func to call once
+// it's answered
+func (m *Metrics) requestStarted() func() {
+	if m == nil {
+		return func() {}
+	}
+
+	atomic.AddInt64(&m.inFlight, 1)
+	return func() { atomic.AddInt64(&m.inFlight, -1) }
+}
+
+// imagizerStarted counts a request to Imagizer in flight, returning a func to
+// call once its body has been copied
+func (m *Metrics) imagizerStarted() func() {
+	if m == nil {
+		return func() {}
+	}
+
+	atomic.AddInt64(&m.imagizerInFlight, 1)
+	return func() { atomic.AddInt64(&m.imagizerInFlight, -1) }
+}
+
+func (m *Metrics) request(version, env string, status int, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.requests.add(1, version, env, strconv.Itoa(status))
+	m.duration.observe(elapsed.Seconds())
+}
+
+func (m *Metrics) stage(stage string, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.stages.observe(elapsed.Seconds(), stage)
+}
+
+func (m *Metrics) served(version string, n int64) {
+	if m == nil {
+		return
+	}
+
+	m.bytes.add(float64(n), version)
+}
+
+// write writes every metric, with db's pool and replicas when it's set
+func (m *Metrics) write(w io.Writer, db *DB) {
+	m.requests.write(w)
+	m.bytes.write(w)
+	m.duration.write(w)
+	m.stages.write(w)
+	writeGauge(w, "ibex_requests_in_flight", "Image requests being answered.",
+		float64(atomic.LoadInt64(&m.inFlight)))
+	writeGauge(w, "ibex_imagizer_requests_in_flight", "Requests to Imagizer being answered.",
+		float64(atomic.LoadInt64(&m.imagizerInFlight)))
+
+	if db == nil {
+		return
+	}
+
+	pool := db.poolStats()
+	writeGauge(w, "ibex_db_pool_max_open", "Maximum open database connections.", float64(pool.MaxOpen))
+	writeGauge(w, "ibex_db_pool_open", "Open database connections.", float64(pool.Open))
+	writeGauge(w, "ibex_db_pool_in_use", "Database connections in use.", float64(pool.InUse))
+	writeGauge(w, "ibex_db_pool_idle", "Idle database connections.", float64(pool.Idle))
+	writeCounter(w, "ibex_db_pool_wait_total", "Waits for a database connection.", float64(pool.WaitCount))
+	writeCounter(w, "ibex_db_pool_wait_seconds_total", "Time spent waiting for a database connection.",
+		float64(pool.WaitDurationMilli)/1000)
+	writeCounter(w, "ibex_db_primary_fallbacks_total", "Reads sent to the primary for want of a healthy replica.",
+		float64(atomic.LoadUint64(&db.primaryFallbacks)))
+}
+
+// metricsHandler serves the metrics in the Prometheus text format
+type metricsHandler struct {
+	metrics *Metrics
+	db      *DB
+	logger  ILogger
+}
+
+func (h metricsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Body != nil {
+		h.logger.CloseQuietly(req.Body)
+	}
+	h.logger.Debug("Request for /metrics")
+
+	var buf bytes.Buffer
+	h.metrics.write(&buf, h.db)
+
+	w.Header().Set("Content-Type", metricsContentType)
+	_, _ = w.Write(buf.Bytes())
+}
+
+// envLabel keeps label values bounded: envs without a bucket are counted as
+// unknown, since anyone can put any env in a path
+func envLabel(env string) string {
+	if _, ok := BucketNames[env]; !ok {
+		return unknownLabel
+	}
+
+	return env
+}
+
+// requestLabels picks the version and env labels of an image request.
+// Versions and envs that aren't configured are counted as unknown.
+func requestLabels(c *Config, path string) (version, env string) {
+	if !pathMatcher.MatchString(path) {
+		return unknownLabel, unknownLabel
+	}
+
+	parts := extractPathPartsToMap(path)
+	version = parts["name"]
+	if _, ok := c.version(version); !ok {
+		version = unknownLabel
+	}
+
+	return version, envLabel(parts["env"])
+}
@@ -0,0 +1,133 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMetricVecs(t *testing.T) {
+	Convey("Metric vectors", t, func() {
+		Convey("Counters are written by label", func() {
+			v := newCounterVec("test_total", "Test counter.", "version", "status")
+			v.add(1, "thumb", "200")
+			v.add(2, "thumb", "200")
+			v.add(1, `odd"name`, "404")
+
+			var buf bytes.Buffer
+			v.write(&buf)
+			So(buf.String(), ShouldEqual, `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{version="odd\"name",status="404"} 1
+test_total{version="thumb",status="200"} 3
+`)
+		})
+
+		Convey("Histograms count every bucket at or above the value", func() {
+			v := newHistogramVec("test_seconds", "Test histogram.", []float64{.1, 1}, "stage")
+			v.observe(.05, "db")
+			v.observe(.5, "db")
+
+			var buf bytes.Buffer
+			v.write(&buf)
+			So(buf.String(), ShouldContainSubstring, `test_seconds_bucket{stage="db",le="0.1"} 1`)
+			So(buf.String(), ShouldContainSubstring, `test_seconds_bucket{stage="db",le="1"} 2`)
+			So(buf.String(), ShouldContainSubstring, `test_seconds_bucket{stage="db",le="+Inf"} 2`)
+			So(buf.String(), ShouldContainSubstring, `test_seconds_sum{stage="db"} 0.55`)
+			So(buf.String(), ShouldContainSubstring, `test_seconds_count{stage="db"} 2`)
+		})
+
+		Convey("Series past the cap are counted together", func() {
+			v := newCounterVec("test_total", "Test counter.", "env")
+			for i := 0; i < maxSeries+5; i++ {
+				v.add(1, fmt.Sprintf("env%d", i))
+			}
+
+			So(v.series, ShouldHaveLength, maxSeries+1)
+			So(v.with([]string{"env9999"}).value, ShouldEqual, 5)
+		})
+	})
+}
+
+func TestRequestLabels(t *testing.T) {
+	Convey("Request labels", t, func() {
+		config := load()
+
+		version, env := requestLabels(config, "/uploads/staging/picture/attachment/1/thumb")
+		So(version, ShouldEqual, "thumb")
+		So(env, ShouldEqual, "staging")
+
+		version, _ = requestLabels(config, "/uploads/staging/picture/attachment/1/nope")
+		So(version, ShouldEqual, unknownLabel)
+
+		_, env = requestLabels(config, "/uploads/random123/picture/attachment/1/thumb")
+		So(env, ShouldEqual, unknownLabel)
+
+		version, env = requestLabels(config, "/favicon.ico")
+		So(version, ShouldEqual, unknownLabel)
+		So(env, ShouldEqual, unknownLabel)
+	})
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	Convey("The metrics endpoint", t, withImagizerTestServer(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "jpeg bytes")
+	}, func(server *httptest.Server) {
+		source, err := loadFileSource(path.Join("test_resources", "pictures.ndjson"))
+		So(err, ShouldBeNil)
+
+		metrics := NewMetrics()
+		imagizerHost, _ := url.Parse(server.URL)
+		handler := imagizerHandler{imagizerHost: imagizerHost, config: load(), source: source, logger: testLogger{},
+			statsChan: NewBlackHole(), responseTimeout: time.Second, metrics: metrics}
+
+		for _, reqPath := range []string{
+			"/uploads/staging/picture/attachment/1/thumb",
+			"/uploads/staging/picture/attachment/42/thumb",
+		} {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", reqPath, nil))
+		}
+
+		conn, err := sql.Open("ibex-hanging", "")
+		So(err, ShouldBeNil)
+		conn.SetMaxOpenConns(7)
+
+		w := httptest.NewRecorder()
+		metricsHandler{metrics, &DB{conn: conn}, testLogger{}}.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		body := w.Body.String()
+
+		So(w.Header().Get("Content-Type"), ShouldEqual, metricsContentType)
+		So(body, ShouldContainSubstring, `ibex_requests_total{version="thumb",env="staging",status="200"} 1`)
+		So(body, ShouldContainSubstring, `ibex_requests_total{version="thumb",env="staging",status="404"} 1`)
+		So(body, ShouldContainSubstring, `ibex_served_bytes_total{version="thumb"} 10`)
+		So(body, ShouldContainSubstring, `ibex_request_duration_seconds_count 2`)
+		So(body, ShouldContainSubstring, `ibex_stage_duration_seconds_count{stage="db"} 2`)
+		So(body, ShouldContainSubstring, `ibex_stage_duration_seconds_count{stage="imagizer"} 1`)
+		So(body, ShouldContainSubstring, `ibex_stage_duration_seconds_count{stage="copy"} 1`)
+		So(body, ShouldContainSubstring, "ibex_requests_in_flight 0")
+		So(body, ShouldContainSubstring, "ibex_db_pool_max_open 7")
+	}))
+}
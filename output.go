@@ -0,0 +1,136 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	outputFormats = map[string]bool{"jpeg": true, "png": true, "webp": true, "gif": true}
+	colorMatcher  = regexp.MustCompile(`^#?([0-9a-fA-F]{3}|[0-9a-fA-F]{6}|[0-9a-fA-F]{8})$`)
+	outputKeys    = []string{"quality", "format", "progressive", "strip_metadata", "background_color", "sharpen"}
+)
+
+// OutputOptions contains the output settings of a version. The keys given
+// explicitly are recorded in set, so a version can turn off or reset an
+// option of the one it extends.
+type OutputOptions struct {
+	Quality         int     `json:"quality,omitempty"`
+	Format          string  `json:"format,omitempty"`
+	Progressive     bool    `json:"progressive,omitempty"`
+	StripMetadata   bool    `json:"strip_metadata,omitempty"`
+	BackgroundColor string  `json:"background_color,omitempty"`
+	Sharpen         float64 `json:"sharpen,omitempty"`
+	set             map[string]bool
+}
+
+// recordSet records which output options keys holds
+func (o *OutputOptions) recordSet(keys map[string]json.RawMessage) {
+	for _, key := range outputKeys {
+		if _, ok := keys[key]; ok {
+			if o.set == nil {
+				o.set = make(map[string]bool)
+			}
+			o.set[key] = true
+		}
+	}
+}
+
+// isSet reports whether the option under key was given, or has a value
+func (o OutputOptions) isSet(key string, nonZero bool) bool {
+	return nonZero || o.set[key]
+}
+
+func (o OutputOptions) validate(errs *ConfigErrors, path string) {
+	if o.Quality < 0 || o.Quality > 100 {
+		errs.add(path+".quality", "must be between 1 and 100, or 0 to leave it unset, got %d", o.Quality)
+	}
+	if len(o.Format) > 0 && !outputFormats[o.Format] {
+		errs.add(path+".format", "unknown format %q", o.Format)
+	}
+	if len(o.BackgroundColor) > 0 && !colorMatcher.MatchString(o.BackgroundColor) {
+		errs.add(path+".background_color", "must be a hex color, got %q", o.BackgroundColor)
+	}
+	if o.Sharpen < 0 {
+		errs.add(path+".sharpen", "can't be negative, got %v", o.Sharpen)
+	}
+}
+
+// inherit fills in every option o leaves unset from parent
+func (o OutputOptions) inherit(parent OutputOptions) OutputOptions {
+	if !o.isSet("quality", o.Quality != 0) {
+		o.Quality = parent.Quality
+	}
+	if !o.isSet("format", len(o.Format) > 0) {
+		o.Format = parent.Format
+	}
+	if !o.isSet("progressive", o.Progressive) {
+		o.Progressive = parent.Progressive
+	}
+	if !o.isSet("strip_metadata", o.StripMetadata) {
+		o.StripMetadata = parent.StripMetadata
+	}
+	if !o.isSet("background_color", len(o.BackgroundColor) > 0) {
+		o.BackgroundColor = parent.BackgroundColor
+	}
+	if !o.isSet("sharpen", o.Sharpen != 0) {
+		o.Sharpen = parent.Sharpen
+	}
+
+	if len(parent.set) > 0 {
+		set := make(map[string]bool)
+		for key := range parent.set {
+			set[key] = true
+		}
+		for key := range o.set {
+			set[key] = true
+		}
+		o.set = set
+	}
+
+	return o
+}
+
+// params translates the set options into Imagizer params
+func (o OutputOptions) params() url.Values {
+	vals := url.Values{}
+
+	if o.Quality > 0 {
+		vals.Set("quality", strconv.Itoa(o.Quality))
+	}
+	if len(o.Format) > 0 {
+		vals.Set("format", o.Format)
+	}
+	if o.Progressive {
+		vals.Set("progressive", "true")
+	}
+	if o.StripMetadata {
+		vals.Set("strip", "true")
+	}
+	if len(o.BackgroundColor) > 0 {
+		vals.Set("bgcolor", strings.TrimPrefix(o.BackgroundColor, "#"))
+	}
+	if o.Sharpen > 0 {
+		vals.Set("sharpen", strconv.FormatFloat(o.Sharpen, 'f', -1, 64))
+	}
+
+	return vals
+}
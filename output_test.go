@@ -0,0 +1,102 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestOutputOptionsValidation(t *testing.T) {
+	Convey("Validating output options", t, func() {
+		validate := func(o OutputOptions) ConfigErrors {
+			var errs ConfigErrors
+			o.validate(&errs, "$.versions[0]")
+			return errs
+		}
+
+		So(validate(OutputOptions{}), ShouldBeEmpty)
+		So(validate(OutputOptions{Quality: 60, Format: "webp", BackgroundColor: "#fff", Sharpen: 1.5}), ShouldBeEmpty)
+
+		errs := validate(OutputOptions{Quality: 101, Format: "bmp", BackgroundColor: "white", Sharpen: -1})
+		So(len(errs), ShouldEqual, 4)
+		So(errs[0].Path, ShouldEqual, "$.versions[0].quality")
+		So(errs[0].Message, ShouldContainSubstring, "or 0 to leave it unset")
+		So(errs[1].Path, ShouldEqual, "$.versions[0].format")
+		So(errs[2].Path, ShouldEqual, "$.versions[0].background_color")
+		So(errs[3].Path, ShouldEqual, "$.versions[0].sharpen")
+	})
+}
+
+func TestOutputOptionsParams(t *testing.T) {
+	Convey("Translating output options to Imagizer params", t, func() {
+		o := OutputOptions{Quality: 60, Format: "jpeg", Progressive: true, StripMetadata: true,
+			BackgroundColor: "#000000", Sharpen: 0.5}
+
+		So(o.params().Encode(), ShouldEqual,
+			"bgcolor=000000&format=jpeg&progressive=true&quality=60&sharpen=0.5&strip=true")
+		So(OutputOptions{}.params(), ShouldBeEmpty)
+
+		Convey("Inherits unset options", func() {
+			child := OutputOptions{Quality: 80}.inherit(o)
+
+			So(child.Quality, ShouldEqual, 80)
+			So(child.Format, ShouldEqual, "jpeg")
+			So(child.Progressive, ShouldBeTrue)
+		})
+
+		Convey("Keeps options turned off explicitly", func() {
+			var v Version
+			err := json.Unmarshal([]byte(`{"name": ":plain", "quality": 0, "progressive": false, "sharpen": 0}`), &v)
+			So(err, ShouldBeNil)
+
+			child := v.OutputOptions.inherit(o)
+			So(child.Quality, ShouldEqual, 0)
+			So(child.Progressive, ShouldBeFalse)
+			So(child.Sharpen, ShouldEqual, 0)
+			So(child.StripMetadata, ShouldBeTrue)
+			So(child.params().Encode(), ShouldEqual, "bgcolor=000000&format=jpeg&strip=true")
+		})
+	})
+}
+
+func TestVersionOutputConfig(t *testing.T) {
+	Convey("Version output options from config", t, func() {
+		config, err := LoadConfig(path.Join("test_resources", "run_config.json"))
+		So(err, ShouldBeNil)
+
+		handler := watermarkTestHandler()
+		rinfo := requestInfo{pictureID: 1, env: "staging",
+			versionInfo: config.versionsByName["large_watermarked"],
+			info:        pictureInfo{userID: 2, ownerID: 1, attachment: "pic.jpg"}}
+
+		u, err := handler.imagizerURL(context.Background(), rinfo)
+		So(err, ShouldBeNil)
+		So(u.Query().Get("quality"), ShouldEqual, "60")
+
+		Convey("Rejects unknown version keys", func() {
+			var v Version
+			err := json.Unmarshal([]byte(`{"name": ":large", "qualty": 60}`), &v)
+
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "qualty")
+		})
+	})
+}
@@ -0,0 +1,335 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"  // Registers the GIF decoder for logos
+	_ "image/jpeg" // Registers the JPEG decoder for logos
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	overlayPath          = "/overlays/tiled.png"
+	overlayCanvasSize    = 1200
+	overlayTileAngle     = 45
+	overlayCacheSize     = 64
+	overlayFetchTimeout  = 5 * time.Second
+	overlayCacheMaxAge   = 24 * time.Hour
+	defaultWatermarkLogo = "https://www.snapshots.com/images/icon.png"
+
+	// Logos are refused past these limits before they're decoded, so a huge
+	// image can't exhaust the memory of the process
+	maxOverlayLogoBytes  = 5 << 20
+	maxOverlayLogoPixels = 2048 * 2048
+)
+
+// overlayCache holds rendered overlays, evicting the oldest when full
+type overlayCache struct {
+	mu      sync.Mutex
+	size    int
+	order   []string
+	entries map[string][]byte
+}
+
+func newOverlayCache(size int) *overlayCache {
+	return &overlayCache{
+		size:    size,
+		entries: make(map[string][]byte),
+	}
+}
+
+func (c *overlayCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	body, ok := c.entries[key]
+	return body, ok
+}
+
+func (c *overlayCache) put(key string, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+
+	if len(c.order) >= c.size {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+
+	c.order = append(c.order, key)
+	c.entries[key] = body
+}
+
+// overlaySignature signs an overlay's params with secret, so only the
+// overlays ibex links to can be rendered
+func overlaySignature(secret, logo string, scale int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = fmt.Fprintf(mac, "%s|%d", logo, scale)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// tiledOverlayURL returns the signed URL Imagizer fetches a tiled overlay from
+func tiledOverlayURL(host, secret, logo string, scale int64) string {
+	vals := url.Values{}
+	vals.Add("logo", logo)
+	vals.Add("scale", strconv.FormatInt(scale, 10))
+	vals.Add("sig", overlaySignature(secret, logo, scale))
+
+	return fmt.Sprintf("%s%s?%s", host, overlayPath, vals.Encode())
+}
+
+type overlayHandler struct {
+	config *Config
+	logger ILogger
+	cache  *overlayCache
+	client *http.Client
+}
+
+func newOverlayHandler(c *Config, logger ILogger) overlayHandler {
+	h := overlayHandler{
+		config: c,
+		logger: logger,
+		cache:  newOverlayCache(overlayCacheSize),
+	}
+	h.client = &http.Client{Timeout: overlayFetchTimeout, CheckRedirect: h.checkRedirect}
+
+	return h
+}
+
+// checkRedirect only follows redirects to hosts allowedLogo accepts
+func (h overlayHandler) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("Stopped after 10 redirects")
+	}
+	if !h.allowedLogo(req.URL) {
+		return fmt.Errorf("Redirect not allowed: %s", req.URL)
+	}
+
+	return nil
+}
+
+// allowedLogo only lets the overlay renderer fetch logos from our CDN or
+// the default watermark, so it can't be used as an open proxy
+func (h overlayHandler) allowedLogo(logo *url.URL) bool {
+	cdn, err := url.Parse(h.config.CDNHost)
+	if err == nil && logo.Host == cdn.Host {
+		return true
+	}
+
+	def, _ := url.Parse(defaultWatermarkLogo)
+	return logo.Host == def.Host
+}
+
+func (h overlayHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet || req.URL.Path != overlayPath {
+		http.NotFound(w, req)
+		return
+	}
+	h.logger.Debug("Request for overlay: %s", req.URL)
+
+	query := req.URL.Query()
+	scale, err := strconv.ParseInt(query.Get("scale"), 10, 64)
+	if err != nil || scale <= 0 || scale > 100 {
+		http.Error(w, fmt.Sprintf("Invalid scale: %s", query.Get("scale")), http.StatusBadRequest)
+		return
+	}
+
+	sig := overlaySignature(h.config.OverlaySecret, query.Get("logo"), scale)
+	if len(h.config.OverlaySecret) == 0 || !hmac.Equal([]byte(query.Get("sig")), []byte(sig)) {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+
+	logo, err := url.Parse(query.Get("logo"))
+	if err != nil || !logo.IsAbs() || !h.allowedLogo(logo) {
+		http.Error(w, fmt.Sprintf("Logo not allowed: %s", query.Get("logo")), http.StatusBadRequest)
+		return
+	}
+
+	key := fmt.Sprintf("%s|%d", logo, scale)
+	body, ok := h.cache.get(key)
+	if !ok {
+		body, err = h.render(logo.String(), scale)
+		if err != nil {
+			h.logger.Warn("Unable to render overlay for %s: %v", logo, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		h.cache.put(key, body)
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(overlayCacheMaxAge.Seconds())))
+	_, err = w.Write(body)
+	if err != nil {
+		h.logger.Warn("Unable to write overlay: %v", err)
+	}
+}
+
+func (h overlayHandler) render(logoURL string, scale int64) ([]byte, error) {
+	resp, err := h.client.Get(logoURL)
+	if err != nil {
+		return nil, err
+	}
+	defer h.logger.CloseQuietly(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %d fetching %s", resp.StatusCode, logoURL)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxOverlayLogoBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxOverlayLogoBytes {
+		return nil, fmt.Errorf("Logo %s is larger than %d bytes", logoURL, maxOverlayLogoBytes)
+	}
+
+	logoConfig, _, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if logoConfig.Width < 1 || logoConfig.Height < 1 || logoConfig.Width*logoConfig.Height > maxOverlayLogoPixels {
+		return nil, fmt.Errorf("Logo %s is %dx%d, more than %d pixels", logoURL,
+			logoConfig.Width, logoConfig.Height, maxOverlayLogoPixels)
+	}
+
+	logo, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, renderTiledOverlay(logo, scale))
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// renderTiledOverlay repeats the logo, rotated diagonally, across a
+// transparent square canvas. The logo is sized to scale percent of the
+// canvas's width, and tall logos are shrunk to fit its height.
+func renderTiledOverlay(logo image.Image, scale int64) *image.RGBA {
+	width := int(overlayCanvasSize * scale / 100)
+	if width < 1 {
+		width = 1
+	}
+	bounds := logo.Bounds()
+	height := width * bounds.Dy() / bounds.Dx()
+	if height > overlayCanvasSize {
+		height = overlayCanvasSize
+		width = overlayCanvasSize * bounds.Dx() / bounds.Dy()
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	tile := rotateImage(resizeImage(logo, width, height), overlayTileAngle)
+	tb := tile.Bounds()
+	canvas := image.NewRGBA(image.Rect(0, 0, overlayCanvasSize, overlayCanvasSize))
+
+	// Every other row is shifted by half a step, so the tiles line up diagonally
+	stepX, stepY := tb.Dx()*2, tb.Dy()*2
+	for row, y := 0, -tb.Dy(); y < overlayCanvasSize; row, y = row+1, y+stepY {
+		x := -tb.Dx()
+		if row%2 == 1 {
+			x += stepX / 2
+		}
+
+		for ; x < overlayCanvasSize; x += stepX {
+			r := image.Rect(x, y, x+tb.Dx(), y+tb.Dy())
+			draw.Draw(canvas, r, tile, tb.Min, draw.Over)
+		}
+	}
+
+	return canvas
+}
+
+// resizeImage scales img to width x height using nearest neighbour sampling
+func resizeImage(img image.Image, width, height int) *image.RGBA {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			sx := b.Min.X + x*b.Dx()/width
+			sy := b.Min.Y + y*b.Dy()/height
+			out.Set(x, y, img.At(sx, sy))
+		}
+	}
+
+	return out
+}
+
+// rotateImage rotates img by degrees onto a transparent canvas big enough
+// to hold the result
+func rotateImage(img *image.RGBA, degrees float64) *image.RGBA {
+	rad := degrees * math.Pi / 180
+	sin, cos := math.Sin(rad), math.Cos(rad)
+
+	b := img.Bounds()
+	w, h := float64(b.Dx()), float64(b.Dy())
+	outW := int(math.Ceil(math.Abs(w*cos) + math.Abs(h*sin)))
+	outH := int(math.Ceil(math.Abs(w*sin) + math.Abs(h*cos)))
+	out := image.NewRGBA(image.Rect(0, 0, outW, outH))
+
+	cx, cy := w/2, h/2
+	ocx, ocy := float64(outW)/2, float64(outH)/2
+
+	for y := 0; y < outH; y++ {
+		for x := 0; x < outW; x++ {
+			dx, dy := float64(x)-ocx, float64(y)-ocy
+			sx := int(math.Floor(dx*cos - dy*sin + cx))
+			sy := int(math.Floor(dx*sin + dy*cos + cy))
+
+			if sx < 0 || sy < 0 || sx >= b.Dx() || sy >= b.Dy() {
+				out.SetRGBA(x, y, color.RGBA{})
+				continue
+			}
+
+			out.SetRGBA(x, y, img.RGBAAt(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+
+	return out
+}
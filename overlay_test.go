@@ -0,0 +1,169 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testLogo() *image.RGBA {
+	logo := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			logo.SetRGBA(x, y, color.RGBA{255, 0, 0, 255})
+		}
+	}
+
+	return logo
+}
+
+func TestOverlayCache(t *testing.T) {
+	Convey("Overlay cache evicts the oldest entry when full", t, func() {
+		cache := newOverlayCache(2)
+		cache.put("a", []byte("a"))
+		cache.put("b", []byte("b"))
+		cache.put("c", []byte("c"))
+
+		_, ok := cache.get("a")
+		So(ok, ShouldBeFalse)
+
+		body, ok := cache.get("c")
+		So(ok, ShouldBeTrue)
+		So(string(body), ShouldEqual, "c")
+	})
+}
+
+func TestRenderTiledOverlay(t *testing.T) {
+	Convey("Rendering a tiled overlay", t, func() {
+		overlay := renderTiledOverlay(testLogo(), 10)
+
+		So(overlay.Bounds().Dx(), ShouldEqual, overlayCanvasSize)
+		So(overlay.Bounds().Dy(), ShouldEqual, overlayCanvasSize)
+
+		opaque := 0
+		for y := 0; y < overlayCanvasSize; y += 10 {
+			for x := 0; x < overlayCanvasSize; x += 10 {
+				if overlay.RGBAAt(x, y).A > 0 {
+					opaque++
+				}
+			}
+		}
+
+		So(opaque, ShouldBeGreaterThan, 0)
+		So(opaque, ShouldBeLessThan, (overlayCanvasSize/10)*(overlayCanvasSize/10))
+
+		Convey("Shrinks tall logos to fit the canvas", func() {
+			tall := image.NewRGBA(image.Rect(0, 0, 1, 2000))
+			overlay := renderTiledOverlay(tall, 100)
+
+			So(overlay.Bounds().Dx(), ShouldEqual, overlayCanvasSize)
+			So(overlay.Bounds().Dy(), ShouldEqual, overlayCanvasSize)
+		})
+	})
+}
+
+func TestOverlayHandler(t *testing.T) {
+	Convey("Overlay handler", t, func() {
+		evilServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_ = png.Encode(w, testLogo())
+		}))
+		defer evilServer.Close()
+
+		logoServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/moved.png":
+				http.Redirect(w, r, "/logo.png", http.StatusFound)
+				return
+			case "/evil.png":
+				http.Redirect(w, r, evilServer.URL+"/logo.png", http.StatusFound)
+				return
+			case "/huge.png":
+				_ = png.Encode(w, image.NewGray(image.Rect(0, 0, 4096, 2048)))
+				return
+			}
+			_ = png.Encode(w, testLogo())
+		}))
+		defer logoServer.Close()
+
+		config := load()
+		config.CDNHost = logoServer.URL
+		config.OverlaySecret = "overlay secret"
+		handler := newOverlayHandler(config, testLogger{})
+
+		Convey("Renders and caches overlays for CDN logos", func() {
+			u := tiledOverlayURL("http://ibex.test", "overlay secret", logoServer.URL+"/logo.png", 15)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", u, nil))
+
+			So(w.Code, ShouldEqual, 200)
+			So(w.Header().Get("Content-Type"), ShouldEqual, "image/png")
+
+			_, ok := handler.cache.get(logoServer.URL + "/logo.png|15")
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Refuses logos from other hosts", func() {
+			u := tiledOverlayURL("http://ibex.test", "overlay secret", "http://evil.test/logo.png", 15)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", u, nil))
+
+			So(w.Code, ShouldEqual, 400)
+		})
+
+		Convey("Only follows redirects to allowed hosts", func() {
+			u := tiledOverlayURL("http://ibex.test", "overlay secret", logoServer.URL+"/moved.png", 15)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", u, nil))
+			So(w.Code, ShouldEqual, 200)
+
+			u = tiledOverlayURL("http://ibex.test", "overlay secret", logoServer.URL+"/evil.png", 15)
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", u, nil))
+			So(w.Code, ShouldEqual, 502)
+			So(w.Body.String(), ShouldContainSubstring, "Redirect not allowed")
+		})
+
+		Convey("Refuses params it didn't sign", func() {
+			for _, u := range []string{
+				tiledOverlayURL("http://ibex.test", "other secret", logoServer.URL+"/logo.png", 15),
+				strings.Replace(tiledOverlayURL("http://ibex.test", "overlay secret", logoServer.URL+"/logo.png", 15), "scale=15", "scale=16", 1),
+			} {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest("GET", u, nil))
+
+				So(w.Code, ShouldEqual, 403)
+			}
+			So(handler.cache.order, ShouldBeEmpty)
+		})
+
+		Convey("Refuses logos with too many pixels", func() {
+			u := tiledOverlayURL("http://ibex.test", "overlay secret", logoServer.URL+"/huge.png", 15)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", u, nil))
+
+			So(w.Code, ShouldEqual, 502)
+			So(w.Body.String(), ShouldContainSubstring, "more than")
+		})
+	})
+}
@@ -0,0 +1,149 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// paramValue is a version param, parsed once when the config is loaded and
+// encoded into the Imagizer query of every request for the version
+type paramValue interface {
+	encode(vals url.Values, key string, repeated map[string]bool)
+}
+
+// scalarParam is a string, number or bool param, already formatted
+type scalarParam string
+
+// listParam is a list of scalars. It's joined with commas, or given as one
+// value per repeated key when its key is in repeated_params.
+type listParam []string
+
+// compositeParam is an object param, flattened into key_field the way
+// Imagizer names them, e.g. {"mark": {"alpha": 50}} becomes mark_alpha=50.
+// Its fields are sorted by name.
+type compositeParam []namedParam
+
+type namedParam struct {
+	name  string
+	value paramValue
+}
+
+func (p scalarParam) encode(vals url.Values, key string, repeated map[string]bool) {
+	vals.Add(key, string(p))
+}
+
+func (p listParam) encode(vals url.Values, key string, repeated map[string]bool) {
+	if !repeated[key] {
+		vals.Add(key, strings.Join(p, ","))
+		return
+	}
+
+	for _, item := range p {
+		vals.Add(key, item)
+	}
+}
+
+func (p compositeParam) encode(vals url.Values, key string, repeated map[string]bool) {
+	for _, field := range p {
+		field.value.encode(vals, key+"_"+field.name, repeated)
+	}
+}
+
+// formatScalarParam formats a string, number or bool param value. Floats
+// keep their fraction, so 1.5 stays 1.5 and 360 stays 360.
+func formatScalarParam(val interface{}) (scalarParam, error) {
+	switch val := val.(type) {
+	case string:
+		return scalarParam(val), nil
+	case int:
+		return scalarParam(strconv.Itoa(val)), nil
+	case int64:
+		return scalarParam(strconv.FormatInt(val, 10)), nil
+	case float64:
+		return scalarParam(strconv.FormatFloat(val, 'f', -1, 64)), nil
+	case bool:
+		return scalarParam(strconv.FormatBool(val)), nil
+	default:
+		return "", fmt.Errorf("unsupported type %T", val)
+	}
+}
+
+// parseVersionParam parses the version param key. Params ibex handles itself
+// are checked and kept as they are, and params named after version
+// properties are refused.
+func parseVersionParam(key string, val interface{}) (interface{}, error) {
+	if versionKeys[key] {
+		return nil, fmt.Errorf("%s is a version property, not a param", key)
+	}
+
+	if kind, ok := optionParams[key]; ok {
+		if val == nil || reflect.TypeOf(val).Kind() != kind {
+			return nil, fmt.Errorf("must be a %s, got %T", kind, val)
+		}
+
+		return val, nil
+	}
+
+	return parseParam(val)
+}
+
+// parseParam parses a version param from its decoded JSON: a scalar, a list
+// of scalars or an object of params
+func parseParam(val interface{}) (paramValue, error) {
+	switch val := val.(type) {
+	case []interface{}:
+		items := make(listParam, len(val))
+		for i, item := range val {
+			s, err := formatScalarParam(item)
+			if err != nil {
+				return nil, fmt.Errorf("item %d: %v", i, err)
+			}
+			items[i] = string(s)
+		}
+
+		return items, nil
+	case map[string]interface{}:
+		names := make([]string, 0, len(val))
+		for name := range val {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fields := make(compositeParam, len(names))
+		for i, name := range names {
+			field, err := parseParam(val[name])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			fields[i] = namedParam{name, field}
+		}
+
+		return fields, nil
+	default:
+		s, err := formatScalarParam(val)
+		if err != nil {
+			return nil, err
+		}
+
+		return s, nil
+	}
+}
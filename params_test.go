@@ -0,0 +1,103 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseParam(t *testing.T) {
+	Convey("Parsing and encoding version params", t, func() {
+		encode := func(key string, val interface{}, repeated map[string]bool) (string, error) {
+			param, err := parseParam(val)
+			if err != nil {
+				return "", err
+			}
+
+			vals := url.Values{}
+			param.encode(vals, key, repeated)
+			return vals.Encode(), nil
+		}
+
+		Convey("Parses into typed params", func() {
+			param, err := parseParam(map[string]interface{}{"y": 0.75, "x": []interface{}{1.0, "a"}})
+			So(err, ShouldBeNil)
+			So(param, ShouldResemble, compositeParam{
+				{"x", listParam{"1", "a"}},
+				{"y", scalarParam("0.75")},
+			})
+		})
+
+		Convey("Keeps floats", func() {
+			q, err := encode("scale", 1.5, nil)
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, "scale=1.5")
+
+			q, _ = encode("width", 360.0, nil)
+			So(q, ShouldEqual, "width=360")
+		})
+
+		Convey("Joins lists with commas unless the key repeats", func() {
+			list := []interface{}{"sharpen", 2.0, true}
+
+			q, err := encode("filter", list, nil)
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, "filter=sharpen%2C2%2Ctrue")
+
+			q, err = encode("filter", list, map[string]bool{"filter": true})
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, "filter=sharpen&filter=2&filter=true")
+		})
+
+		Convey("Flattens objects into composite params", func() {
+			q, err := encode("focus", map[string]interface{}{"x": 0.25, "y": 0.75}, nil)
+			So(err, ShouldBeNil)
+			So(q, ShouldEqual, "focus_x=0.25&focus_y=0.75")
+		})
+
+		Convey("Rejects nulls and nested lists", func() {
+			_, err := encode("width", nil, nil)
+			So(err, ShouldNotBeNil)
+
+			_, err = encode("filter", []interface{}{[]interface{}{1.0}}, nil)
+			So(err, ShouldNotBeNil)
+
+			_, err = encode("focus", map[string]interface{}{"x": nil}, nil)
+			So(err.Error(), ShouldContainSubstring, "x:")
+		})
+	})
+}
+
+func TestImagizerURLTypedParams(t *testing.T) {
+	Convey("Imagizer URLs carry typed params", t, func() {
+		handler := watermarkTestHandler()
+		rinfo := requestInfo{pictureID: 1, env: "staging",
+			info: pictureInfo{userID: 1, ownerID: 1, attachment: "pic.jpg"},
+			versionInfo: map[string]interface{}{
+				"scale":           scalarParam("1.5"),
+				"filter":          listParam{"blur", "sharpen"},
+				"repeated_params": map[string]bool{"filter": true},
+			}}
+
+		u, err := handler.imagizerURL(context.Background(), rinfo)
+		So(err, ShouldBeNil)
+		So(u.RawQuery, ShouldEqual, "filter=blur&filter=sharpen&scale=1.5")
+	})
+}
@@ -0,0 +1,406 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	defaultPictureCacheSize        = 10000
+	defaultPictureCacheTTL         = 60
+	defaultPictureCacheNegativeTTL = 10
+	defaultPictureCacheChannel     = "ibex_invalidate"
+
+	listenerMinReconnect = time.Second
+	listenerMaxReconnect = time.Minute
+)
+
+var notifyChannelMatcher = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// PictureCacheConfig contains configuration for the picture info cache
+type PictureCacheConfig struct {
+	Enabled            bool   `json:"enabled"`
+	Size               int    `json:"size"`
+	TTLSeconds         int    `json:"ttl_seconds"`
+	NegativeTTLSeconds int    `json:"negative_ttl_seconds"`
+	NotifyChannel      string `json:"notify_channel"`
+	PrefetchNeighbours int    `json:"prefetch_neighbours"`
+	PrefetchSecret     string `json:"prefetch_secret" secret:"true"`
+}
+
+func (c PictureCacheConfig) size() int {
+	if c.Size == 0 {
+		return defaultPictureCacheSize
+	}
+
+	return c.Size
+}
+
+func (c PictureCacheConfig) ttl() time.Duration {
+	if c.TTLSeconds == 0 {
+		return defaultPictureCacheTTL * time.Second
+	}
+
+	return time.Duration(c.TTLSeconds) * time.Second
+}
+
+func (c PictureCacheConfig) negativeTTL() time.Duration {
+	if c.NegativeTTLSeconds == 0 {
+		return defaultPictureCacheNegativeTTL * time.Second
+	}
+
+	return time.Duration(c.NegativeTTLSeconds) * time.Second
+}
+
+func (c PictureCacheConfig) channel() string {
+	if len(c.NotifyChannel) == 0 {
+		return defaultPictureCacheChannel
+	}
+
+	return c.NotifyChannel
+}
+
+func (c PictureCacheConfig) validate(errs *ConfigErrors, path string) {
+	if !c.Enabled {
+		return
+	}
+
+	if c.Size < 0 {
+		errs.add(path+".size", "must not be negative, got %d", c.Size)
+	}
+	if c.TTLSeconds < 0 {
+		errs.add(path+".ttl_seconds", "must not be negative, got %d", c.TTLSeconds)
+	}
+	if c.NegativeTTLSeconds < 0 {
+		errs.add(path+".negative_ttl_seconds", "must not be negative, got %d", c.NegativeTTLSeconds)
+	}
+	if c.PrefetchNeighbours < 0 || c.PrefetchNeighbours > maxPrefetchIDs {
+		errs.add(path+".prefetch_neighbours", "must be between 0 and %d, got %d", maxPrefetchIDs, c.PrefetchNeighbours)
+	}
+	if !notifyChannelMatcher.MatchString(c.channel()) {
+		errs.add(path+".notify_channel", "must be a lowercase Postgres identifier, got %q", c.NotifyChannel)
+	}
+}
+
+type pictureCacheEntry struct {
+	id      int
+	info    pictureInfo
+	err     error
+	expires time.Time
+}
+
+// pictureCache holds recently loaded picture info, including pictures that
+// weren't found, evicting the least recently used when full. With read
+// replicas, pictures invalidated within primaryWindow are read from the
+// primary, since a replica may not have replayed the change yet.
+type pictureCache struct {
+	mu            sync.Mutex
+	size          int
+	ttl           time.Duration
+	negativeTTL   time.Duration
+	order         *list.List
+	entries       map[int]*list.Element
+	generation    uint64
+	primaryWindow time.Duration
+	primaryUntil  time.Time
+	invalidated   map[int]time.Time
+	now           func() time.Time
+}
+
+func newPictureCache(c PictureCacheConfig) *pictureCache {
+	return &pictureCache{
+		size:        c.size(),
+		ttl:         c.ttl(),
+		negativeTTL: c.negativeTTL(),
+		order:       list.New(),
+		entries:     make(map[int]*list.Element),
+		invalidated: make(map[int]time.Time),
+		now:         time.Now,
+	}
+}
+
+// readFromPrimary tells whether the picture was invalidated so recently that
+// a replica may still return its old info
+func (c *pictureCache) readFromPrimary(id int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	return now.Before(c.primaryUntil) || now.Before(c.invalidated[id])
+}
+
+// markInvalidated sends reads of the picture, or of every picture when all
+// is set, to the primary for the next primaryWindow. The caller holds c.mu.
+func (c *pictureCache) markInvalidated(id int, all bool) {
+	if c.primaryWindow == 0 {
+		return
+	}
+
+	now := c.now()
+	until := now.Add(c.primaryWindow)
+	if all {
+		c.primaryUntil = until
+		c.invalidated = make(map[int]time.Time)
+		return
+	}
+
+	if len(c.invalidated) >= c.size {
+		for invalidated, expires := range c.invalidated {
+			if !now.Before(expires) {
+				delete(c.invalidated, invalidated)
+			}
+		}
+	}
+	c.invalidated[id] = until
+}
+
+// get returns the cached info or noRowsErr for the picture, if it's fresh
+func (c *pictureCache) get(id int) (pictureCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[id]
+	if !ok {
+		return pictureCacheEntry{}, false
+	}
+
+	entry := el.Value.(pictureCacheEntry)
+	if !c.now().Before(entry.expires) {
+		return pictureCacheEntry{}, false
+	}
+
+	c.order.MoveToFront(el)
+	return entry, true
+}
+
+// getStale returns the cached entry for the picture even if it's expired,
+// as long as it expired less than maxStale ago. Expired entries are kept
+// until they're evicted, for serving while the database is down.
+func (c *pictureCache) getStale(id int, maxStale time.Duration) (pictureCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[id]
+	if !ok {
+		return pictureCacheEntry{}, false
+	}
+
+	entry := el.Value.(pictureCacheEntry)
+	if !c.now().Before(entry.expires.Add(maxStale)) {
+		return pictureCacheEntry{}, false
+	}
+
+	return entry, true
+}
+
+// currentGeneration is taken before querying, so put can tell whether an
+// invalidation arrived while the query ran
+func (c *pictureCache) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generation
+}
+
+// put caches a query result unless the cache was invalidated since
+// generation, in which case the result may already be stale
+func (c *pictureCache) put(id int, generation uint64, info pictureInfo, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	ttl := c.ttl
+	if err != nil {
+		ttl = c.negativeTTL
+	}
+
+	entry := pictureCacheEntry{id: id, info: info, err: err, expires: c.now().Add(ttl)}
+	if el, ok := c.entries[id]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+
+	if c.order.Len() >= c.size {
+		c.remove(c.order.Back())
+	}
+
+	c.entries[id] = c.order.PushFront(entry)
+}
+
+func (c *pictureCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(pictureCacheEntry).id)
+}
+
+func (c *pictureCache) invalidatePicture(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.markInvalidated(id, false)
+	if el, ok := c.entries[id]; ok {
+		c.remove(el)
+	}
+}
+
+// invalidateWhere drops the pictures matching drop. The pictures it would
+// match that weren't cached can't be told apart, so every read goes to the
+// primary for a while.
+func (c *pictureCache) invalidateWhere(drop func(info pictureInfo) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.markInvalidated(0, true)
+	for el := c.order.Front(); el != nil; {
+		next := el.Next()
+		if entry := el.Value.(pictureCacheEntry); entry.err == nil && drop(entry.info) {
+			c.remove(el)
+		}
+		el = next
+	}
+}
+
+// invalidateWatermark drops the pictures with the watermark
+func (c *pictureCache) invalidateWatermark(id int64) {
+	c.invalidateWhere(func(info pictureInfo) bool {
+		return info.mark.id.Valid && info.mark.id.Int64 == id
+	})
+}
+
+// invalidateEvent drops the pictures of the event, which may have changed
+// owner or been deleted
+func (c *pictureCache) invalidateEvent(id int64) {
+	c.invalidateWhere(func(info pictureInfo) bool {
+		return int64(info.eventID) == id
+	})
+}
+
+// invalidatePhotographerInfo drops the pictures of the photographer info's
+// user. Pictures whose uploader had none are dropped too, since the info may
+// be new or have moved to another user.
+func (c *pictureCache) invalidatePhotographerInfo(id int64) {
+	c.invalidateWhere(func(info pictureInfo) bool {
+		return !info.photographerInfoID.Valid || info.photographerInfoID.Int64 == id
+	})
+}
+
+func (c *pictureCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.markInvalidated(0, true)
+	c.order.Init()
+	c.entries = make(map[int]*list.Element)
+}
+
+// handleNotification invalidates whatever a "<table>:<id>" payload from the
+// notify triggers touches. Pictures, watermarks, events and photographer
+// infos drop the pictures they're part of, and anything else flushes the
+// whole cache.
+func (c *pictureCache) handleNotification(payload string) error {
+	parts := strings.SplitN(payload, ":", 2)
+	if len(parts) != 2 {
+		c.flush()
+		return fmt.Errorf("Malformed notification %q", payload)
+	}
+
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		c.flush()
+		return fmt.Errorf("Malformed notification %q", payload)
+	}
+
+	switch parts[0] {
+	case "pictures":
+		c.invalidatePicture(int(id))
+	case "watermarks":
+		c.invalidateWatermark(id)
+	case "events":
+		c.invalidateEvent(id)
+	case "photographer_infos":
+		c.invalidatePhotographerInfo(id)
+	default:
+		c.flush()
+	}
+
+	return nil
+}
+
+// listenForInvalidations applies notifications from the database to the
+// picture cache until the listener is closed. The cache is flushed whenever
+// the connection is re-established, since notifications may have been missed.
+func (db *DB) listenForInvalidations(c *Config, logger ILogger) {
+	channel := c.PictureCache.channel()
+	listener := pq.NewListener(c.DatabaseURL, listenerMinReconnect, listenerMaxReconnect,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				logger.Warn("Picture cache listener: %v", err)
+			}
+		})
+	defer logger.CloseQuietly(listener)
+
+	listenRetrying(listener.Listen, channel, listenerMinReconnect, listenerMaxReconnect, logger)
+	logger.Info("Listening for picture cache invalidations on %s", channel)
+
+	for n := range listener.Notify {
+		if n == nil {
+			logger.Info("Picture cache listener reconnected, flushing the cache")
+			db.cache.flush()
+			continue
+		}
+
+		logger.Debug("Picture cache invalidation: %s", n.Extra)
+		if err := db.cache.handleNotification(n.Extra); err != nil {
+			logger.Warn("%v", err)
+		}
+	}
+}
+
+// listenRetrying calls listen on channel until it succeeds, waiting from
+// minDelay up to maxDelay between attempts. Until then the picture cache
+// relies on its TTL.
+func listenRetrying(listen func(string) error, channel string, minDelay, maxDelay time.Duration, logger ILogger) {
+	delay := minDelay
+	for {
+		err := listen(channel)
+		if err == nil {
+			return
+		}
+
+		logger.Warn("Not listening on %s yet, retrying in %s: %v", channel, delay, err)
+		time.Sleep(delay)
+
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
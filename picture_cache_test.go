@@ -0,0 +1,194 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPictureCache(t *testing.T) {
+	Convey("Caching picture info", t, func() {
+		now := time.Date(2016, 6, 1, 12, 0, 0, 0, time.UTC)
+		cache := newPictureCache(PictureCacheConfig{Size: 2, TTLSeconds: 60, NegativeTTLSeconds: 5})
+		cache.now = func() time.Time { return now }
+
+		marked := pictureInfo{userID: 1, eventID: 3, photographerInfoID: newNullInt64(5),
+			mark: watermark{id: newNullInt64(7)}}
+		cache.put(1, cache.currentGeneration(), marked, nil)
+		cache.put(2, cache.currentGeneration(), pictureInfo{}, newNoRowsError("No picture found with id %d", 2))
+
+		Convey("Returns fresh entries", func() {
+			entry, ok := cache.get(1)
+			So(ok, ShouldBeTrue)
+			So(entry.info.userID, ShouldEqual, 1)
+
+			entry, ok = cache.get(2)
+			So(ok, ShouldBeTrue)
+			So(entry.err, ShouldHaveSameTypeAs, noRowsErr{})
+		})
+
+		Convey("Expires missing pictures sooner", func() {
+			now = now.Add(10 * time.Second)
+
+			_, ok := cache.get(2)
+			So(ok, ShouldBeFalse)
+			_, ok = cache.get(1)
+			So(ok, ShouldBeTrue)
+
+			now = now.Add(time.Minute)
+			_, ok = cache.get(1)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Evicts the least recently used", func() {
+			cache.get(1)
+			cache.put(3, cache.currentGeneration(), pictureInfo{}, nil)
+
+			_, ok := cache.get(2)
+			So(ok, ShouldBeFalse)
+			_, ok = cache.get(1)
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Drops results loaded across an invalidation", func() {
+			generation := cache.currentGeneration()
+			cache.invalidatePicture(1)
+			cache.put(1, generation, marked, nil)
+
+			_, ok := cache.get(1)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Applies notifications", func() {
+			So(cache.handleNotification("watermarks:7"), ShouldBeNil)
+			_, ok := cache.get(1)
+			So(ok, ShouldBeFalse)
+			_, ok = cache.get(2)
+			So(ok, ShouldBeTrue)
+
+			So(cache.handleNotification("pictures:2"), ShouldBeNil)
+			_, ok = cache.get(2)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Drops the pictures of events and photographer infos", func() {
+			So(cache.handleNotification("events:4"), ShouldBeNil)
+			So(cache.handleNotification("photographer_infos:6"), ShouldBeNil)
+			_, ok := cache.get(1)
+			So(ok, ShouldBeTrue)
+
+			So(cache.handleNotification("events:3"), ShouldBeNil)
+			_, ok = cache.get(1)
+			So(ok, ShouldBeFalse)
+
+			cache.put(1, cache.currentGeneration(), marked, nil)
+			So(cache.handleNotification("photographer_infos:5"), ShouldBeNil)
+			_, ok = cache.get(1)
+			So(ok, ShouldBeFalse)
+
+			cache.put(1, cache.currentGeneration(), pictureInfo{userID: 1}, nil)
+			So(cache.handleNotification("photographer_infos:6"), ShouldBeNil)
+			_, ok = cache.get(1)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Flushes on other tables and malformed payloads", func() {
+			So(cache.handleNotification("users:1"), ShouldBeNil)
+			So(cache.order.Len(), ShouldEqual, 0)
+
+			cache.put(1, cache.currentGeneration(), marked, nil)
+			So(cache.handleNotification("pictures"), ShouldNotBeNil)
+			So(cache.order.Len(), ShouldEqual, 0)
+		})
+
+		Convey("Reads recently invalidated pictures from the primary", func() {
+			cache.invalidatePicture(1)
+			So(cache.readFromPrimary(1), ShouldBeFalse)
+
+			cache.primaryWindow = 10 * time.Second
+			cache.invalidatePicture(1)
+			So(cache.readFromPrimary(1), ShouldBeTrue)
+			So(cache.readFromPrimary(2), ShouldBeFalse)
+
+			cache.invalidateWatermark(7)
+			So(cache.readFromPrimary(2), ShouldBeTrue)
+
+			now = now.Add(10 * time.Second)
+			So(cache.readFromPrimary(1), ShouldBeFalse)
+			So(cache.readFromPrimary(2), ShouldBeFalse)
+
+			cache.flush()
+			So(cache.readFromPrimary(2), ShouldBeTrue)
+		})
+	})
+}
+
+func TestListenRetrying(t *testing.T) {
+	Convey("Listening for invalidations", t, func() {
+		attempts := 0
+		listen := func(channel string) error {
+			attempts++
+			if attempts < 3 {
+				return errors.New("connection refused")
+			}
+			return nil
+		}
+
+		listenRetrying(listen, "ibex_invalidate", time.Millisecond, 2*time.Millisecond, testLogger{})
+		So(attempts, ShouldEqual, 3)
+	})
+}
+
+func TestPictureCacheValidation(t *testing.T) {
+	Convey("Validating the picture cache config", t, func() {
+		var errs ConfigErrors
+		PictureCacheConfig{Enabled: true}.validate(&errs, "$.picture_cache")
+		So(errs, ShouldBeEmpty)
+
+		PictureCacheConfig{Enabled: true, TTLSeconds: -1, NotifyChannel: "Bad-Channel"}.validate(&errs, "$.picture_cache")
+		So(len(errs), ShouldEqual, 2)
+		So(errs[0].Path, ShouldEqual, "$.picture_cache.ttl_seconds")
+		So(errs[1].Path, ShouldEqual, "$.picture_cache.notify_channel")
+	})
+}
+
+func TestCachedPictureInfo(t *testing.T) {
+	Convey("Loading picture info through the cache", t, withTestFixtures(func(config *Config, db *DB, logger testLogger) {
+		ctx := context.WithValue(context.Background(), "logger", logger)
+		db.cache = newPictureCache(PictureCacheConfig{})
+
+		info, err := db.loadPictureInfo(ctx, 1)
+		So(err, ShouldBeNil)
+
+		_, err = db.conn.Exec("update pictures set attachment = 'changed.jpg' where id = 1")
+		So(err, ShouldBeNil)
+		defer db.conn.Exec("update pictures set attachment = 'test_pic.jpg' where id = 1")
+
+		cached, err := db.loadPictureInfo(ctx, 1)
+		So(err, ShouldBeNil)
+		So(cached.attachment, ShouldEqual, info.attachment)
+
+		So(db.cache.handleNotification("pictures:1"), ShouldBeNil)
+		fresh, err := db.loadPictureInfo(ctx, 1)
+		So(err, ShouldBeNil)
+		So(fresh.attachment, ShouldEqual, "changed.jpg")
+	}))
+}
@@ -0,0 +1,316 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+)
+
+const (
+	prefetchPath         = "/prefetch"
+	prefetchHeader       = "X-Ibex-Prefetch"
+	prefetchSecretHeader = "X-Ibex-Prefetch-Secret"
+	maxPrefetchIDs       = 200
+
+	// Background prefetches run on prefetchWorkers goroutines, and at most
+	// prefetchQueue wait for one. Any more are dropped.
+	prefetchWorkers = 4
+	prefetchQueue   = 100
+)
+
+var errCacheDisabled = errors.New("The picture cache is disabled")
+
+// picturePrefetcher is a PictureInfoSource that can load many pictures into
+// its cache at once
+type picturePrefetcher interface {
+	prefetch(ctx context.Context, ids []int) (int, error)
+}
+
+// prefetchPool runs background prefetches on a fixed set of workers. A job
+// is skipped while another with the same key is queued or running, and
+// dropped when the queue is full.
+type prefetchPool struct {
+	jobs chan prefetchJob
+
+	mu       sync.Mutex
+	inFlight map[string]bool
+}
+
+type prefetchJob struct {
+	key string
+	run func()
+}
+
+func newPrefetchPool(workers, queue int) *prefetchPool {
+	p := &prefetchPool{
+		jobs:     make(chan prefetchJob, queue),
+		inFlight: make(map[string]bool),
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+// submit queues run under key, returning false if it was skipped or dropped
+func (p *prefetchPool) submit(key string, run func()) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.inFlight[key] {
+		return false
+	}
+
+	select {
+	case p.jobs <- prefetchJob{key, run}:
+		p.inFlight[key] = true
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *prefetchPool) work() {
+	for job := range p.jobs {
+		job.run()
+
+		p.mu.Lock()
+		delete(p.inFlight, job.key)
+		p.mu.Unlock()
+	}
+}
+
+// parsePictureIDs parses a comma-separated list of picture ids
+func parsePictureIDs(raw string) ([]int, error) {
+	var ids []int
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+
+		id, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid picture id %q", part)
+		}
+		ids = append(ids, id)
+	}
+
+	if len(ids) > maxPrefetchIDs {
+		return nil, fmt.Errorf("At most %d pictures can be prefetched at once, got %d", maxPrefetchIDs, len(ids))
+	}
+
+	return ids, nil
+}
+
+// cacheReplicaRead caches a result that may have come from a replica, unless
+// the picture was invalidated recently enough for the replica to be behind
+func (db *DB) cacheReplicaRead(id int, generation uint64, info pictureInfo, err error) {
+	if !db.cache.readFromPrimary(id) {
+		db.cache.put(id, generation, info, err)
+	}
+}
+
+// cachePictureRows caches every picture in rows, returning the ids found
+func (db *DB) cachePictureRows(rows *sql.Rows, generation uint64) (map[int]bool, error) {
+	defer rows.Close()
+
+	found := make(map[int]bool)
+	for rows.Next() {
+		info := pictureInfo{}
+		var id int
+		if err := rows.Scan(info.scanDest(&id)...); err != nil {
+			return found, err
+		}
+
+		info.mark.mungePosition()
+		db.cacheReplicaRead(id, generation, info, nil)
+		found[id] = true
+	}
+
+	return found, rows.Err()
+}
+
+// prefetch loads the pictures that aren't cached yet with a single query,
+// caching the ones that don't exist as missing, and returns how many it
+// loaded
+func (db *DB) prefetch(ctx context.Context, ids []int) (int, error) {
+	if db.cache == nil {
+		return 0, errCacheDisabled
+	}
+
+	var missing []int64
+	for _, id := range ids {
+		if _, ok := db.cache.get(id); !ok {
+			missing = append(missing, int64(id))
+		}
+	}
+	if len(missing) == 0 {
+		return 0, nil
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, db.queryTimeout)
+	defer cancel()
+
+	generation := db.cache.currentGeneration()
+	rows, err := db.queryRows(ctxTimeout, db.queries.batch, pq.Array(missing))
+	if err != nil {
+		return 0, err
+	}
+
+	found, err := db.cachePictureRows(rows, generation)
+	if err != nil {
+		return len(found), err
+	}
+
+	for _, id := range missing {
+		if !found[int(id)] {
+			db.cacheReplicaRead(int(id), generation, pictureInfo{}, newNoRowsError("No picture found with id %d", id))
+		}
+	}
+
+	return len(found), nil
+}
+
+// loadNeighbours caches the pictures of the same event closest to id, so the
+// rest of a gallery is ready before it's requested
+func (db *DB) loadNeighbours(logger ILogger, id int) {
+	ctx, cancel := context.WithTimeout(context.Background(), db.queryTimeout)
+	defer cancel()
+
+	generation := db.cache.currentGeneration()
+	rows, err := db.queryRows(ctx, db.queries.neighbours, id, db.neighbours)
+	if err != nil {
+		logger.Warn("Prefetching the neighbours of picture %d: %v", id, err)
+		return
+	}
+
+	found, err := db.cachePictureRows(rows, generation)
+	if err != nil {
+		logger.Warn("Prefetching the neighbours of picture %d: %v", id, err)
+		return
+	}
+
+	logger.Debug("Prefetched %d neighbours of picture %d", len(found), id)
+}
+
+// prefetchAuthorized checks the request's prefetch secret header against the
+// configured secret. Nothing is authorized when no secret is configured.
+func prefetchAuthorized(config *Config, req *http.Request) bool {
+	secret := config.PictureCache.PrefetchSecret
+	given := req.Header.Get(prefetchSecretHeader)
+	return len(secret) > 0 && subtle.ConstantTimeCompare([]byte(given), []byte(secret)) == 1
+}
+
+// prefetchHandler loads the pictures listed in its ids param into the cache
+type prefetchHandler struct {
+	config *Config
+	source PictureInfoSource
+	logger ILogger
+}
+
+func (h prefetchHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Body != nil {
+		h.logger.CloseQuietly(req.Body)
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !prefetchAuthorized(h.config, req) {
+		h.logger.Warn("Refusing a prefetch without a valid %s from %s", prefetchSecretHeader, req.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	ids, err := parsePictureIDs(req.URL.Query().Get("ids"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	prefetcher, ok := h.source.(picturePrefetcher)
+	if !ok {
+		http.Error(w, "Prefetching needs the postgres source", http.StatusNotImplemented)
+		return
+	}
+
+	ctx := context.WithValue(req.Context(), "logger", h.logger)
+	loaded, err := prefetcher.prefetch(ctx, ids)
+	switch {
+	case err == errCacheDisabled:
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	case err != nil:
+		h.logger.Warn("Prefetching %v: %v", ids, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.logger.Debug("Prefetched %d of %d pictures", loaded, len(ids))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"requested": len(ids), "loaded": loaded})
+}
+
+// prefetchHint queues the pictures listed in a request's prefetch header to
+// be prefetched in the background. The header is only trusted alongside the
+// configured prefetch secret, since anyone can send it on an image request.
+func (h imagizerHandler) prefetchHint(req *http.Request, logger ILogger) {
+	hint := req.Header.Get(prefetchHeader)
+	if len(hint) == 0 {
+		return
+	}
+
+	prefetcher, ok := h.source.(picturePrefetcher)
+	if !ok || h.prefetches == nil {
+		return
+	}
+
+	if !prefetchAuthorized(h.config, req) {
+		logger.Warn("Ignoring %s without a valid %s", prefetchHeader, prefetchSecretHeader)
+		return
+	}
+
+	ids, err := parsePictureIDs(hint)
+	if err != nil {
+		logger.Warn("Ignoring %s: %v", prefetchHeader, err)
+		return
+	}
+
+	queued := h.prefetches.submit(hint, func() {
+		ctx := context.WithValue(context.Background(), "logger", logger)
+		if _, err := prefetcher.prefetch(ctx, ids); err != nil && err != errCacheDisabled {
+			logger.Warn("Prefetching %v: %v", ids, err)
+		}
+	})
+	if !queued {
+		logger.Debug("Not prefetching %v, already queued or too many pending", ids)
+	}
+}
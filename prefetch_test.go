@@ -0,0 +1,259 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// pictureRowsDriver answers every query with pictures 1 and 2, counting the
+// queries it runs
+type pictureRowsDriver struct {
+	queries *int
+}
+
+type pictureRowsStmt struct{ pictureRowsDriver }
+
+type pictureRows struct {
+	ids []int64
+}
+
+func (d pictureRowsDriver) Open(string) (driver.Conn, error) { return d, nil }
+func (d pictureRowsDriver) Prepare(string) (driver.Stmt, error) {
+	return pictureRowsStmt{d}, nil
+}
+func (d pictureRowsDriver) Close() error              { return nil }
+func (d pictureRowsDriver) Begin() (driver.Tx, error) { return nil, errors.New("unsupported") }
+
+func (s pictureRowsStmt) NumInput() int { return -1 }
+func (s pictureRowsStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("unsupported")
+}
+func (s pictureRowsStmt) Query([]driver.Value) (driver.Rows, error) {
+	*s.queries++
+	return &pictureRows{ids: []int64{1, 2}}, nil
+}
+
+func (r *pictureRows) Columns() []string { return make([]string, 21) }
+func (r *pictureRows) Close() error      { return nil }
+func (r *pictureRows) Next(dest []driver.Value) error {
+	if len(r.ids) == 0 {
+		return io.EOF
+	}
+
+	for i := range dest {
+		dest[i] = nil
+	}
+	dest[0], dest[1], dest[2], dest[3] = int64(10), "pic.jpg", int64(3), int64(10)
+	dest[12] = "---\n- top\n- left\n"
+	dest[19] = false
+	dest[20] = r.ids[0]
+	r.ids = r.ids[1:]
+
+	return nil
+}
+
+var pictureRowsQueries int
+
+func init() {
+	sql.Register("ibex-pictures", pictureRowsDriver{&pictureRowsQueries})
+}
+
+func prefetchTestDB(config PictureCacheConfig) *DB {
+	conn, _ := sql.Open("ibex-pictures", "")
+	return &DB{
+		conn:           conn,
+		queries:        SoftDeleteConfig{}.queries(false),
+		cache:          newPictureCache(config),
+		neighbours:     config.PrefetchNeighbours,
+		neighbourLoads: newPrefetchPool(1, 1),
+		queryTimeout:   time.Second,
+	}
+}
+
+func TestParsePictureIDs(t *testing.T) {
+	Convey("Parsing picture ids", t, func() {
+		ids, err := parsePictureIDs("1, 2,,3")
+		So(err, ShouldBeNil)
+		So(ids, ShouldResemble, []int{1, 2, 3})
+
+		_, err = parsePictureIDs("1,two")
+		So(err, ShouldNotBeNil)
+
+		_, err = parsePictureIDs(strings.Repeat("1,", maxPrefetchIDs+1))
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestPrefetch(t *testing.T) {
+	Convey("Prefetching pictures", t, func() {
+		db := prefetchTestDB(PictureCacheConfig{})
+		ctx := context.WithValue(context.Background(), "logger", testLogger{})
+		pictureRowsQueries = 0
+
+		loaded, err := db.prefetch(ctx, []int{1, 2, 3})
+		So(err, ShouldBeNil)
+		So(loaded, ShouldEqual, 2)
+		So(pictureRowsQueries, ShouldEqual, 1)
+
+		info, err := db.loadPictureInfo(ctx, 2)
+		So(err, ShouldBeNil)
+		So(info.attachment, ShouldEqual, "pic.jpg")
+		So(info.mark.position.String, ShouldEqual, "top,left")
+
+		_, err = db.loadPictureInfo(ctx, 3)
+		So(err, ShouldHaveSameTypeAs, noRowsErr{})
+		So(pictureRowsQueries, ShouldEqual, 1)
+
+		loaded, err = db.prefetch(ctx, []int{1, 2})
+		So(err, ShouldBeNil)
+		So(loaded, ShouldEqual, 0)
+		So(pictureRowsQueries, ShouldEqual, 1)
+
+		Convey("Needs the cache", func() {
+			db.cache = nil
+			_, err := db.prefetch(ctx, []int{1})
+			So(err, ShouldEqual, errCacheDisabled)
+		})
+	})
+}
+
+func TestPrefetchNeighbours(t *testing.T) {
+	Convey("Loading a picture prefetches its neighbours", t, func() {
+		db := prefetchTestDB(PictureCacheConfig{PrefetchNeighbours: 5})
+		ctx := context.WithValue(context.Background(), "logger", testLogger{})
+
+		_, err := db.loadPictureInfo(ctx, 1)
+		So(err, ShouldBeNil)
+
+		cached := false
+		for i := 0; i < 50 && !cached; i++ {
+			time.Sleep(time.Millisecond)
+			_, cached = db.cache.get(2)
+		}
+		So(cached, ShouldBeTrue)
+	})
+}
+
+func TestPrefetchPool(t *testing.T) {
+	Convey("Running prefetches in the background", t, func() {
+		pool := newPrefetchPool(1, 1)
+		release := make(chan bool)
+		var ran sync.WaitGroup
+		ran.Add(2)
+
+		So(pool.submit("a", func() { <-release; ran.Done() }), ShouldBeTrue)
+		So(pool.submit("a", func() {}), ShouldBeFalse)
+
+		// The worker may not have taken "a" off the queue yet
+		queued := false
+		for i := 0; i < 50 && !queued; i++ {
+			queued = pool.submit("b", func() { ran.Done() })
+			time.Sleep(time.Millisecond)
+		}
+		So(queued, ShouldBeTrue)
+		So(pool.submit("c", func() {}), ShouldBeFalse)
+
+		close(release)
+		ran.Wait()
+		So(pool.submit("a", func() {}), ShouldBeTrue)
+	})
+}
+
+func TestPrefetchHint(t *testing.T) {
+	Convey("Prefetching from a request header", t, func() {
+		db := prefetchTestDB(PictureCacheConfig{})
+		config := &Config{PictureCache: PictureCacheConfig{PrefetchSecret: "s3cret"}}
+		handler := imagizerHandler{config: config, source: db, prefetches: newPrefetchPool(1, 1)}
+
+		hinted := func(secret string) bool {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(prefetchHeader, "1,2")
+			req.Header.Set(prefetchSecretHeader, secret)
+			handler.prefetchHint(req, testLogger{})
+
+			cached := false
+			for i := 0; i < 50 && !cached; i++ {
+				time.Sleep(time.Millisecond)
+				_, cached = db.cache.get(2)
+			}
+			return cached
+		}
+
+		So(hinted("wrong"), ShouldBeFalse)
+
+		config.PictureCache.PrefetchSecret = ""
+		So(hinted(""), ShouldBeFalse)
+
+		config.PictureCache.PrefetchSecret = "s3cret"
+		So(hinted("s3cret"), ShouldBeTrue)
+	})
+}
+
+func TestPrefetchHandler(t *testing.T) {
+	Convey("The prefetch endpoint", t, func() {
+		config := &Config{PictureCache: PictureCacheConfig{PrefetchSecret: "s3cret"}}
+		handler := prefetchHandler{config, prefetchTestDB(PictureCacheConfig{}), testLogger{}}
+		request := func(method, target, secret string) *http.Request {
+			req := httptest.NewRequest(method, target, nil)
+			req.Header.Set(prefetchSecretHeader, secret)
+			return req
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, request("POST", "/prefetch?ids=1,2,3", "wrong"))
+		So(w.Code, ShouldEqual, 403)
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, request("POST", "/prefetch?ids=1,2,3", "s3cret"))
+		So(w.Code, ShouldEqual, 200)
+		So(w.Body.String(), ShouldContainSubstring, `"loaded":2`)
+		So(w.Body.String(), ShouldContainSubstring, `"requested":3`)
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, request("GET", "/prefetch?ids=x", "s3cret"))
+		So(w.Code, ShouldEqual, 400)
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, request("DELETE", "/prefetch?ids=1", "s3cret"))
+		So(w.Code, ShouldEqual, 405)
+
+		source, err := loadFileSource(path.Join("test_resources", "pictures.json"))
+		So(err, ShouldBeNil)
+		handler.source = source
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, request("GET", "/prefetch?ids=1", "s3cret"))
+		So(w.Code, ShouldEqual, 501)
+
+		config.PictureCache.PrefetchSecret = ""
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, request("GET", "/prefetch?ids=1", ""))
+		So(w.Code, ShouldEqual, 403)
+	})
+}
@@ -0,0 +1,288 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	readyPath = "/readyz"
+
+	checkOK      = "ok"
+	checkFailing = "failing"
+
+	defaultImagizerProbeSeconds = 10
+	defaultDatabaseProbeSeconds = 5
+	defaultReadyTimeoutMilli    = 2000
+	shutdownTimeout             = 20 * time.Second
+)
+
+var errDraining = errors.New("Draining for shutdown")
+
+// ReadinessConfig contains configuration for /readyz. The Imagizer and
+// database probes' results are reused for imagizer_probe_seconds and
+// database_probe_seconds, and on SIGTERM ibex reports itself unready for
+// drain_seconds before it stops taking requests.
+type ReadinessConfig struct {
+	ImagizerProbeSeconds int `json:"imagizer_probe_seconds"`
+	DatabaseProbeSeconds int `json:"database_probe_seconds"`
+	DrainSeconds         int `json:"drain_seconds"`
+	TimeoutMillis        int `json:"timeout_ms"`
+}
+
+func (c ReadinessConfig) imagizerProbeInterval() time.Duration {
+	if c.ImagizerProbeSeconds == 0 {
+		return defaultImagizerProbeSeconds * time.Second
+	}
+
+	return time.Duration(c.ImagizerProbeSeconds) * time.Second
+}
+
+func (c ReadinessConfig) databaseProbeInterval() time.Duration {
+	if c.DatabaseProbeSeconds == 0 {
+		return defaultDatabaseProbeSeconds * time.Second
+	}
+
+	return time.Duration(c.DatabaseProbeSeconds) * time.Second
+}
+
+func (c ReadinessConfig) drainTime() time.Duration {
+	return time.Duration(c.DrainSeconds) * time.Second
+}
+
+func (c ReadinessConfig) timeout() time.Duration {
+	if c.TimeoutMillis == 0 {
+		return defaultReadyTimeoutMilli * time.Millisecond
+	}
+
+	return time.Duration(c.TimeoutMillis) * time.Millisecond
+}
+
+func (c ReadinessConfig) validate(errs *ConfigErrors, path string) {
+	for _, field := range []struct {
+		key string
+		val int
+	}{
+		{"imagizer_probe_seconds", c.ImagizerProbeSeconds},
+		{"database_probe_seconds", c.DatabaseProbeSeconds},
+		{"drain_seconds", c.DrainSeconds},
+		{"timeout_ms", c.TimeoutMillis},
+	} {
+		if field.val < 0 {
+			errs.add(path+"."+field.key, "must not be negative, got %d", field.val)
+		}
+	}
+}
+
+// CheckResult is the outcome of one readiness check
+type CheckResult struct {
+	Status       string     `json:"status"`
+	LatencyMilli float64    `json:"latency_ms"`
+	CheckedAt    *time.Time `json:"checked_at,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+func newCheckResult(started time.Time, err error) CheckResult {
+	result := CheckResult{
+		Status:       checkOK,
+		LatencyMilli: float64(time.Since(started)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		result.Status = checkFailing
+		result.Error = redactCredentials(err.Error())
+	}
+
+	return result
+}
+
+// ReadyStatus is the body of /readyz
+type ReadyStatus struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// cachedProbe runs a readiness check, keeping the result for interval so load
+// balancer checks don't turn into a stream of requests to what it checks
+type cachedProbe struct {
+	interval time.Duration
+	probe    func(ctx context.Context) error
+
+	mu        sync.Mutex
+	last      CheckResult
+	checkedAt time.Time
+}
+
+// newImagizerProbe checks that Imagizer answers. Any answer short of a server
+// error means it's reachable.
+func newImagizerProbe(url string, interval, timeout time.Duration) *cachedProbe {
+	client := &http.Client{Timeout: timeout}
+
+	return &cachedProbe{interval: interval, probe: func(ctx context.Context) error {
+		req, err := http.NewRequest(http.MethodHead, url, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("Imagizer answered %s", resp.Status)
+		}
+
+		return nil
+	}}
+}
+
+// newDatabaseProbe checks that the database answers a ping
+func newDatabaseProbe(conn *sql.DB, interval time.Duration) *cachedProbe {
+	return &cachedProbe{interval: interval, probe: conn.PingContext}
+}
+
+// check returns the last result if it's recent enough, and probes otherwise
+func (p *cachedProbe) check(ctx context.Context) CheckResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.checkedAt.IsZero() && time.Since(p.checkedAt) < p.interval {
+		return p.last
+	}
+
+	started := time.Now()
+	err := p.probe(ctx)
+
+	p.checkedAt = started
+	p.last = newCheckResult(started, err)
+	checkedAt := p.checkedAt
+	p.last.CheckedAt = &checkedAt
+
+	return p.last
+}
+
+// readiness decides whether ibex should be sent requests: the database and
+// Imagizer answer, and it isn't draining for shutdown. With degraded mode
+// enabled ibex can serve without the database, so its check is only
+// reported.
+type readiness struct {
+	source           PictureInfoSource
+	database         *cachedProbe
+	databaseAdvisory bool
+	imagizer         *cachedProbe
+	timeout          time.Duration
+	drain            time.Duration
+	draining         int32
+	stopped          chan struct{}
+}
+
+func newReadiness(c *Config, source PictureInfoSource, db *DB) *readiness {
+	r := &readiness{
+		source:   source,
+		imagizer: newImagizerProbe(c.ImagizerHost, c.Readiness.imagizerProbeInterval(), c.Readiness.timeout()),
+		timeout:  c.Readiness.timeout(),
+		drain:    c.Readiness.drainTime(),
+		stopped:  make(chan struct{}),
+	}
+	if db != nil {
+		r.database = newDatabaseProbe(db.conn, c.Readiness.databaseProbeInterval())
+		r.databaseAdvisory = c.DegradedMode.Enabled
+	}
+
+	return r
+}
+
+func (r *readiness) isDraining() bool {
+	return atomic.LoadInt32(&r.draining) == 1
+}
+
+func (r *readiness) status() ReadyStatus {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	status := ReadyStatus{Status: checkOK, Checks: make(map[string]CheckResult)}
+
+	var drainErr error
+	if r.isDraining() {
+		drainErr = errDraining
+	}
+	status.Checks["draining"] = newCheckResult(time.Now(), drainErr)
+
+	if r.database != nil {
+		status.Checks["database"] = r.database.check(ctx)
+	}
+
+	status.Checks["imagizer"] = r.imagizer.check(ctx)
+
+	for name, check := range status.Checks {
+		if check.Status != checkOK && !(name == "database" && r.databaseAdvisory) {
+			status.Status = checkFailing
+		}
+	}
+
+	return status
+}
+
+// drainOnTerm waits for SIGTERM, then reports unready for the drain time so
+// load balancers stop sending requests before server shuts down. stopped is
+// closed once the requests in flight are answered.
+func (r *readiness) drainOnTerm(server *http.Server, logger ILogger) {
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM)
+	<-term
+
+	atomic.StoreInt32(&r.draining, 1)
+	logger.Info("Draining for %s before shutting down", r.drain)
+	time.Sleep(r.drain)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	logger.HandleErr(server.Shutdown(ctx))
+	close(r.stopped)
+}
+
+// readyHandler serves /readyz, answering 503 when any check fails
+type readyHandler struct {
+	ready  *readiness
+	logger ILogger
+}
+
+func (h readyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Body != nil {
+		h.logger.CloseQuietly(req.Body)
+	}
+
+	status := h.ready.status()
+
+	w.Header().Set("Content-Type", "application/json")
+	if status.Status != checkOK {
+		h.logger.Debug("Not ready: %+v", status.Checks)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,143 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestImagizerProbe(t *testing.T) {
+	Convey("Probing Imagizer", t, func() {
+		var hits int32
+		status := int32(http.StatusOK)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+		}))
+		defer server.Close()
+
+		ctx := context.Background()
+
+		Convey("Results are cached for the interval", func() {
+			probe := newImagizerProbe(server.URL, time.Hour, time.Second)
+			So(probe.check(ctx).Status, ShouldEqual, checkOK)
+			So(probe.check(ctx).Status, ShouldEqual, checkOK)
+			So(atomic.LoadInt32(&hits), ShouldEqual, 1)
+		})
+
+		Convey("Server errors fail the check", func() {
+			atomic.StoreInt32(&status, http.StatusBadGateway)
+			probe := newImagizerProbe(server.URL, 0, time.Second)
+			result := probe.check(ctx)
+			So(result.Status, ShouldEqual, checkFailing)
+			So(result.Error, ShouldContainSubstring, "502")
+
+			atomic.StoreInt32(&status, http.StatusNotFound)
+			So(probe.check(ctx).Status, ShouldEqual, checkOK)
+		})
+
+		Convey("Unreachable hosts fail the check", func() {
+			probe := newImagizerProbe("http://127.0.0.1:1", 0, time.Second)
+			So(probe.check(ctx).Status, ShouldEqual, checkFailing)
+		})
+	})
+}
+
+func TestReadyHandler(t *testing.T) {
+	Convey("Readiness", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer server.Close()
+
+		conn, err := sql.Open("ibex-one", "")
+		So(err, ShouldBeNil)
+
+		config := load()
+		config.ImagizerHost = server.URL
+		db := &DB{conn: conn}
+		ready := newReadiness(config, db, db)
+
+		serve := func() (int, ReadyStatus) {
+			w := httptest.NewRecorder()
+			readyHandler{ready, testLogger{}}.ServeHTTP(w, httptest.NewRequest("GET", readyPath, nil))
+
+			var status ReadyStatus
+			So(json.Unmarshal(w.Body.Bytes(), &status), ShouldBeNil)
+			return w.Code, status
+		}
+
+		code, status := serve()
+		So(code, ShouldEqual, http.StatusOK)
+		So(status.Status, ShouldEqual, checkOK)
+		So(status.Checks, ShouldContainKey, "database")
+		So(status.Checks, ShouldContainKey, "imagizer")
+		So(status.Checks["draining"].Status, ShouldEqual, checkOK)
+
+		atomic.StoreInt32(&ready.draining, 1)
+		code, status = serve()
+		So(code, ShouldEqual, http.StatusServiceUnavailable)
+		So(status.Status, ShouldEqual, checkFailing)
+		So(status.Checks["draining"].Error, ShouldEqual, errDraining.Error())
+	})
+}
+
+func TestReadyDatabaseCheck(t *testing.T) {
+	Convey("The database readiness check", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer server.Close()
+
+		conn, err := sql.Open("ibex-down", "")
+		So(err, ShouldBeNil)
+		atomic.StoreInt32(&databaseDown, 1)
+		defer atomic.StoreInt32(&databaseDown, 0)
+
+		config := load()
+		config.ImagizerHost = server.URL
+		db := &DB{conn: conn}
+
+		Convey("Fails readiness while the database is down", func() {
+			status := newReadiness(config, db, db).status()
+			So(status.Status, ShouldEqual, checkFailing)
+			So(status.Checks["database"].Status, ShouldEqual, checkFailing)
+		})
+
+		Convey("Is only reported with degraded mode enabled", func() {
+			config.DegradedMode.Enabled = true
+			status := newReadiness(config, db, db).status()
+			So(status.Status, ShouldEqual, checkOK)
+			So(status.Checks["database"].Status, ShouldEqual, checkFailing)
+		})
+
+		Convey("Reuses the last ping for the interval", func() {
+			ready := newReadiness(config, db, db)
+			So(ready.status().Checks["database"].Status, ShouldEqual, checkFailing)
+
+			atomic.StoreInt32(&databaseDown, 0)
+			So(ready.status().Checks["database"].Status, ShouldEqual, checkFailing)
+
+			ready.database.interval = 0
+			So(ready.status().Checks["database"].Status, ShouldEqual, checkOK)
+		})
+	})
+}
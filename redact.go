@@ -0,0 +1,117 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Config fields tagged secret:"true" are never dumped. Credentials embedded
+// in any other string, like the database URLs, are redacted.
+const (
+	secretTag  = "secret"
+	secretFull = "true"
+
+	redactedValue       = "[REDACTED]"
+	redactedCredentials = "xxxxx"
+)
+
+var (
+	urlCredentialsMatcher = regexp.MustCompile(`(?i)([a-z][a-z0-9+.-]*://[^:/?#@\s]*:)[^/\s]*@`)
+	passwordParamMatcher  = regexp.MustCompile(`(?i)(password=)('[^']*'|[^\s&]*)`)
+)
+
+// redactCredentials masks passwords in URLs and key=value connection strings
+func redactCredentials(s string) string {
+	s = urlCredentialsMatcher.ReplaceAllString(s, "${1}"+redactedCredentials+"@")
+	return passwordParamMatcher.ReplaceAllString(s, "${1}"+redactedCredentials)
+}
+
+// secretPaths collects the JSON paths of fields tagged as fully secret
+func secretPaths(t reflect.Type, prefix string, paths map[string]bool) {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if len(field.PkgPath) > 0 || len(name) == 0 || name == "-" {
+			continue
+		}
+
+		path := name
+		if len(prefix) > 0 {
+			path = prefix + "." + name
+		}
+
+		if field.Tag.Get(secretTag) == secretFull {
+			paths[path] = true
+		}
+
+		secretPaths(field.Type, path, paths)
+	}
+}
+
+func redactGeneric(val interface{}, path string, secrets map[string]bool) interface{} {
+	if secrets[path] {
+		return redactedValue
+	}
+
+	switch val := val.(type) {
+	case string:
+		return redactCredentials(val)
+	case map[string]interface{}:
+		for k, v := range val {
+			sub := k
+			if len(path) > 0 {
+				sub = path + "." + k
+			}
+			val[k] = redactGeneric(v, sub, secrets)
+		}
+	case []interface{}:
+		for i, v := range val {
+			val[i] = redactGeneric(v, path, secrets)
+		}
+	}
+
+	return val
+}
+
+// redactedJSON marshals v with its secrets redacted
+func redactedJSON(v interface{}) ([]byte, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var generic interface{}
+	err = json.Unmarshal(buf, &generic)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make(map[string]bool)
+	secretPaths(reflect.TypeOf(v), "", secrets)
+
+	return json.Marshal(redactGeneric(generic, "", secrets))
+}
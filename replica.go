@@ -0,0 +1,315 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	selectionRoundRobin   = "round_robin"
+	selectionLeastLatency = "least_latency"
+
+	defaultMaxReplicaLagMilli  = 5000
+	defaultReplicaCheckSeconds = 5
+
+	// replicaLagSQL is whether the replica's WAL receiver is connected to
+	// the primary, and how far its replay is behind, or zero when it has
+	// replayed everything it received, so an idle primary doesn't look like
+	// lag. A disconnected replica has nothing left to replay either, so it's
+	// only caught up while it's receiving.
+	replicaLagSQL = `
+SELECT EXISTS (SELECT 1 FROM pg_stat_wal_receiver),
+  CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+    ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+  END;`
+)
+
+var errReplicaDisconnected = errors.New("not receiving WAL from the primary")
+
+func validateReplicaSelection(selection string) error {
+	switch selection {
+	case "", selectionRoundRobin, selectionLeastLatency:
+		return nil
+	default:
+		return fmt.Errorf("Unknown replica_selection %q, expected %s or %s",
+			selection, selectionRoundRobin, selectionLeastLatency)
+	}
+}
+
+func (c DatabaseConfig) maxReplicaLag() time.Duration {
+	if c.MaxReplicaLagMillis == 0 {
+		return defaultMaxReplicaLagMilli * time.Millisecond
+	}
+
+	return time.Duration(c.MaxReplicaLagMillis) * time.Millisecond
+}
+
+func (c DatabaseConfig) replicaCheckInterval() time.Duration {
+	if c.ReplicaCheckSeconds == 0 {
+		return defaultReplicaCheckSeconds * time.Second
+	}
+
+	return time.Duration(c.ReplicaCheckSeconds) * time.Second
+}
+
+// ReplicaStats is the state of a single read replica
+type ReplicaStats struct {
+	Name         string    `json:"name"`
+	Healthy      bool      `json:"healthy"`
+	LatencyMilli float64   `json:"latency_ms"`
+	LagMilli     int64     `json:"lag_ms"`
+	LastError    string    `json:"last_error,omitempty"`
+	Queries      uint64    `json:"queries"`
+	Errors       uint64    `json:"errors"`
+	Pool         PoolStats `json:"pool"`
+}
+
+// replica is a read replica, only queried while its health checks pass
+type replica struct {
+	queries uint64
+	errors  uint64
+	name    string
+	conn    *sql.DB
+
+	mu      sync.RWMutex
+	stmts   map[string]*sql.Stmt
+	healthy bool
+	latency time.Duration
+	lag     time.Duration
+	lastErr string
+}
+
+func newReplica(url string, c DatabaseConfig) (*replica, error) {
+	conn, err := openPool(url, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &replica{name: redactCredentials(url), conn: conn}, nil
+}
+
+func (r *replica) isHealthy() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.healthy
+}
+
+func (r *replica) currentLatency() time.Duration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.latency
+}
+
+func (r *replica) markUnhealthy(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.healthy = false
+	r.lastErr = redactCredentials(err.Error())
+}
+
+// check measures the replica's latency and lag, preparing q the first time
+// it's reachable, and marks it healthy if it's caught up
+func (r *replica) check(ctx context.Context, q queries, maxLag time.Duration) {
+	started := time.Now()
+	var receiving bool
+	var lagSeconds float64
+	err := r.conn.QueryRowContext(ctx, replicaLagSQL).Scan(&receiving, &lagSeconds)
+	latency := time.Since(started)
+
+	if err != nil {
+		r.markUnhealthy(err)
+		return
+	}
+	if !receiving {
+		r.markUnhealthy(errReplicaDisconnected)
+		return
+	}
+
+	r.mu.RLock()
+	prepared := r.stmts != nil
+	r.mu.RUnlock()
+
+	if !prepared {
+		stmts, err := prepareQueries(ctx, r.conn, q)
+		if err != nil {
+			r.markUnhealthy(err)
+			return
+		}
+
+		r.mu.Lock()
+		r.stmts = stmts
+		r.mu.Unlock()
+	}
+
+	lag := time.Duration(lagSeconds * float64(time.Second))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.latency = latency
+	r.lag = lag
+	r.healthy = lag <= maxLag
+	r.lastErr = ""
+	if !r.healthy {
+		r.lastErr = fmt.Sprintf("lagging %s behind the primary", lag)
+	}
+}
+
+func (r *replica) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	atomic.AddUint64(&r.queries, 1)
+
+	r.mu.RLock()
+	stmts := r.stmts
+	r.mu.RUnlock()
+
+	return queryRow(ctx, r.conn, stmts, query, args...)
+}
+
+func (r *replica) queryRows(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	atomic.AddUint64(&r.queries, 1)
+
+	r.mu.RLock()
+	stmts := r.stmts
+	r.mu.RUnlock()
+
+	return queryRows(ctx, r.conn, stmts, query, args...)
+}
+
+func (r *replica) stats() ReplicaStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return ReplicaStats{
+		Name:         r.name,
+		Healthy:      r.healthy,
+		LatencyMilli: float64(r.latency) / float64(time.Millisecond),
+		LagMilli:     int64(r.lag / time.Millisecond),
+		LastError:    r.lastErr,
+		Queries:      atomic.LoadUint64(&r.queries),
+		Errors:       atomic.LoadUint64(&r.errors),
+		Pool:         poolStats(r.conn),
+	}
+}
+
+// pickReplica chooses a healthy replica to read from, or nil to use the
+// primary
+func (db *DB) pickReplica() *replica {
+	var healthy []*replica
+	for _, r := range db.replicas {
+		if r.isHealthy() {
+			healthy = append(healthy, r)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	if db.replicaSelection == selectionLeastLatency {
+		best := healthy[0]
+		for _, r := range healthy[1:] {
+			if r.currentLatency() < best.currentLatency() {
+				best = r
+			}
+		}
+
+		return best
+	}
+
+	n := atomic.AddUint64(&db.nextReplica, 1)
+	return healthy[int(n%uint64(len(healthy)))]
+}
+
+// scanRow runs query on a healthy replica, or the primary when there's none,
+// and scans the row into dest. A replica that fails is marked unhealthy and
+// the query is retried on the primary.
+func (db *DB) scanRow(ctx context.Context, query string, args []interface{}, dest ...interface{}) error {
+	r := db.pickReplica()
+	if r == nil {
+		return db.queryRow(ctx, query, args...).Scan(dest...)
+	}
+
+	err := r.queryRow(ctx, query, args...).Scan(dest...)
+	if err == nil || err == sql.ErrNoRows || ctx.Err() != nil {
+		return err
+	}
+
+	atomic.AddUint64(&r.errors, 1)
+	atomic.AddUint64(&db.primaryFallbacks, 1)
+	r.markUnhealthy(err)
+
+	return db.queryRow(ctx, query, args...).Scan(dest...)
+}
+
+// queryRows runs query on a healthy replica, or the primary when there's
+// none or the replica fails
+func (db *DB) queryRows(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	if r := db.pickReplica(); r != nil {
+		rows, err := r.queryRows(ctx, query, args...)
+		if err == nil || ctx.Err() != nil {
+			return rows, err
+		}
+
+		atomic.AddUint64(&r.errors, 1)
+		atomic.AddUint64(&db.primaryFallbacks, 1)
+		r.markUnhealthy(err)
+	}
+
+	return queryRows(ctx, db.conn, db.primaryStmts(), query, args...)
+}
+
+// checkReplicas runs the replicas' health checks every interval, forever
+func (db *DB) checkReplicas(interval, maxLag time.Duration, logger ILogger) {
+	for {
+		for _, r := range db.replicas {
+			wasHealthy := r.isHealthy()
+
+			ctx, cancel := context.WithTimeout(context.Background(), db.queryTimeout)
+			r.check(ctx, db.queries, maxLag)
+			cancel()
+
+			st := r.stats()
+			switch {
+			case st.Healthy && !wasHealthy:
+				logger.Info("Replica %s is healthy, lag %dms", st.Name, st.LagMilli)
+			case !st.Healthy && wasHealthy:
+				logger.Warn("Replica %s is unhealthy, reading from the primary: %s", st.Name, st.LastError)
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// replicaStats reports the state of every replica
+func (db *DB) replicaStats() []ReplicaStats {
+	stats := make([]ReplicaStats, len(db.replicas))
+	for i, r := range db.replicas {
+		stats[i] = r.stats()
+	}
+
+	return stats
+}
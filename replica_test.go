@@ -0,0 +1,198 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// staticDriver answers every query with a single row holding value, or with
+// err when it's set. The replica lag query gets whether the WAL receiver is
+// connected as well.
+type staticDriver struct {
+	value        int64
+	err          error
+	disconnected bool
+}
+
+type staticStmt struct {
+	staticDriver
+	query string
+}
+
+type staticRows struct {
+	values []driver.Value
+	done   bool
+}
+
+func (d staticDriver) Open(string) (driver.Conn, error) { return d, nil }
+func (d staticDriver) Prepare(query string) (driver.Stmt, error) {
+	return staticStmt{d, query}, nil
+}
+func (d staticDriver) Close() error              { return nil }
+func (d staticDriver) Begin() (driver.Tx, error) { return nil, errors.New("unsupported") }
+
+func (s staticStmt) NumInput() int { return -1 }
+func (s staticStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("unsupported")
+}
+func (s staticStmt) Query([]driver.Value) (driver.Rows, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	if s.query == replicaLagSQL {
+		return &staticRows{values: []driver.Value{!s.disconnected, s.value}}, nil
+	}
+
+	return &staticRows{values: []driver.Value{s.value}}, nil
+}
+
+func (r *staticRows) Columns() []string { return make([]string, len(r.values)) }
+func (r *staticRows) Close() error      { return nil }
+func (r *staticRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	copy(dest, r.values)
+
+	return nil
+}
+
+func init() {
+	sql.Register("ibex-one", staticDriver{value: 1})
+	sql.Register("ibex-two", staticDriver{value: 2})
+	sql.Register("ibex-failing", staticDriver{err: errors.New("connection reset")})
+	sql.Register("ibex-disconnected", staticDriver{disconnected: true})
+}
+
+func testReplica(driverName string) *replica {
+	conn, _ := sql.Open(driverName, "")
+	return &replica{name: driverName, conn: conn}
+}
+
+func TestReplicaSelection(t *testing.T) {
+	Convey("Picking a replica", t, func() {
+		one, two := testReplica("ibex-one"), testReplica("ibex-two")
+		db := &DB{replicas: []*replica{one, two}}
+
+		So(db.pickReplica(), ShouldBeNil)
+
+		one.healthy, two.healthy = true, true
+		one.latency, two.latency = 5*time.Millisecond, time.Millisecond
+
+		Convey("Round robin alternates", func() {
+			first, second := db.pickReplica(), db.pickReplica()
+			So(first, ShouldNotEqual, second)
+			So(db.pickReplica(), ShouldEqual, first)
+		})
+
+		Convey("Least latency picks the fastest", func() {
+			db.replicaSelection = selectionLeastLatency
+			So(db.pickReplica(), ShouldEqual, two)
+
+			two.healthy = false
+			So(db.pickReplica(), ShouldEqual, one)
+		})
+	})
+}
+
+func TestReplicaHealthChecks(t *testing.T) {
+	Convey("Checking a replica", t, func() {
+		ctx := context.Background()
+		q := SoftDeleteConfig{}.queries(false)
+
+		r := testReplica("ibex-one")
+		r.check(ctx, q, 5*time.Second)
+		So(r.isHealthy(), ShouldBeTrue)
+		So(r.stmts, ShouldNotBeNil)
+		So(r.stats().LagMilli, ShouldEqual, 1000)
+
+		r.check(ctx, q, 500*time.Millisecond)
+		So(r.isHealthy(), ShouldBeFalse)
+		So(r.stats().LastError, ShouldContainSubstring, "lagging")
+
+		failing := testReplica("ibex-failing")
+		failing.check(ctx, q, 5*time.Second)
+		So(failing.isHealthy(), ShouldBeFalse)
+		So(failing.stats().LastError, ShouldEqual, "connection reset")
+
+		disconnected := testReplica("ibex-disconnected")
+		disconnected.check(ctx, q, 5*time.Second)
+		So(disconnected.isHealthy(), ShouldBeFalse)
+		So(disconnected.stats().LastError, ShouldEqual, errReplicaDisconnected.Error())
+	})
+}
+
+func TestReplicaFallback(t *testing.T) {
+	Convey("Reading through replicas", t, func() {
+		ctx := context.Background()
+		primary, _ := sql.Open("ibex-one", "")
+		failing := testReplica("ibex-failing")
+		failing.healthy = true
+		db := &DB{conn: primary, replicas: []*replica{failing}}
+
+		var value int64
+		So(db.scanRow(ctx, "SELECT 1", nil, &value), ShouldBeNil)
+		So(value, ShouldEqual, 1)
+
+		st := failing.stats()
+		So(st.Healthy, ShouldBeFalse)
+		So(st.Queries, ShouldEqual, 1)
+		So(st.Errors, ShouldEqual, 1)
+		So(db.primaryFallbacks, ShouldEqual, 1)
+
+		healthy := testReplica("ibex-two")
+		healthy.healthy = true
+		db.replicas = []*replica{healthy}
+		So(db.scanRow(ctx, "SELECT 2", nil, &value), ShouldBeNil)
+		So(value, ShouldEqual, 2)
+	})
+}
+
+func TestReplicaConfig(t *testing.T) {
+	Convey("Validating replica config", t, func() {
+		var errs ConfigErrors
+		DatabaseConfig{
+			Replicas:         []string{"postgres://replica.test/ibex", "replica.test"},
+			ReplicaSelection: "random",
+		}.validate(&errs, "$.database")
+
+		So(len(errs), ShouldEqual, 2)
+		So(errs[0].Path, ShouldEqual, "$.database.replicas[1]")
+		So(errs[1].Path, ShouldEqual, "$.database.replica_selection")
+
+		Convey("Replicas need the picture cache", func() {
+			config := load()
+			config.Database.Replicas = []string{"postgres://replica.test/ibex"}
+			err := config.Validate()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "$.database.replicas: need the picture cache enabled")
+
+			config.PictureCache.Enabled = true
+			So(config.Validate(), ShouldBeNil)
+		})
+	})
+}
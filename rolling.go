@@ -0,0 +1,156 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// rollingSeconds is the longest window rates are kept for
+	rollingSeconds = 15 * 60
+
+	// latencySamples is how many of the latest latencies are kept per version
+	latencySamples = 1024
+)
+
+var rateWindows = []struct {
+	name   string
+	window time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"15m", 15 * time.Minute},
+}
+
+// Rates are the events per second over the last 1, 5 and 15 minutes
+type Rates map[string]float64
+
+// rollingCounter counts events per second over the last 15 minutes, in a
+// ring of one slot per second
+type rollingCounter struct {
+	counts  [rollingSeconds]uint64
+	seconds [rollingSeconds]int64
+}
+
+func (c *rollingCounter) add(now time.Time) {
+	sec := now.Unix()
+	i := sec % rollingSeconds
+	if c.seconds[i] != sec {
+		c.seconds[i] = sec
+		c.counts[i] = 0
+	}
+	c.counts[i]++
+}
+
+// count sums the events in the window ending at now
+func (c *rollingCounter) count(now time.Time, window time.Duration) uint64 {
+	sec := now.Unix()
+	oldest := sec - int64(window/time.Second)
+
+	var total uint64
+	for i, s := range c.seconds {
+		if s > oldest && s <= sec {
+			total += c.counts[i]
+		}
+	}
+
+	return total
+}
+
+// rates reports the rate over each window. Windows reaching back before
+// started are averaged over the time since started instead.
+func (c *rollingCounter) rates(now, started time.Time) Rates {
+	rates := make(Rates, len(rateWindows))
+	for _, w := range rateWindows {
+		span := w.window
+		if !started.IsZero() && now.Sub(started) < span {
+			span = now.Sub(started)
+			if span < time.Second {
+				span = time.Second
+			}
+		}
+
+		rates[w.name] = float64(c.count(now, w.window)) / span.Seconds()
+	}
+
+	return rates
+}
+
+// Percentiles are the latencies of a version's latest requests, in ms
+type Percentiles struct {
+	P50     float64 `json:"p50"`
+	P90     float64 `json:"p90"`
+	P99     float64 `json:"p99"`
+	Samples int     `json:"samples"`
+}
+
+// latencyRing keeps a version's latest latencies, with when they were taken
+type latencyRing struct {
+	samples []latencySample
+	next    int
+}
+
+type latencySample struct {
+	at      time.Time
+	latency time.Duration
+}
+
+func (r *latencyRing) add(now time.Time, d time.Duration) {
+	sample := latencySample{now, d}
+	if len(r.samples) < latencySamples {
+		r.samples = append(r.samples, sample)
+		return
+	}
+
+	r.samples[r.next] = sample
+	r.next = (r.next + 1) % latencySamples
+}
+
+// percentiles summarizes the samples taken in the 15 minutes up to now
+func (r *latencyRing) percentiles(now time.Time) Percentiles {
+	oldest := now.Add(-rollingSeconds * time.Second)
+	sorted := make([]time.Duration, 0, len(r.samples))
+	for _, s := range r.samples {
+		if s.at.After(oldest) {
+			sorted = append(sorted, s.latency)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return Percentiles{
+		P50:     percentile(sorted, 50),
+		P90:     percentile(sorted, 90),
+		P99:     percentile(sorted, 99),
+		Samples: len(sorted),
+	}
+}
+
+// percentile picks the nearest-rank percentile of sorted, in ms
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+
+	return float64(sorted[rank-1]) / float64(time.Millisecond)
+}
@@ -0,0 +1,101 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRollingCounter(t *testing.T) {
+	Convey("Rolling counters", t, func() {
+		c := &rollingCounter{}
+		now := time.Unix(1500000000, 0)
+
+		for i := 0; i < 60; i++ {
+			c.add(now.Add(-10 * time.Minute))
+		}
+		for i := 0; i < 30; i++ {
+			c.add(now.Add(-30 * time.Second))
+		}
+
+		Convey("Count the events in each window", func() {
+			So(c.count(now, time.Minute), ShouldEqual, 30)
+			So(c.count(now, 5*time.Minute), ShouldEqual, 30)
+			So(c.count(now, 15*time.Minute), ShouldEqual, 90)
+		})
+
+		Convey("Report events per second", func() {
+			rates := c.rates(now, time.Time{})
+			So(rates["1m"], ShouldEqual, 0.5)
+			So(rates["5m"], ShouldEqual, 0.1)
+			So(rates["15m"], ShouldEqual, 0.1)
+		})
+
+		Convey("Average over the uptime while it's shorter than the window", func() {
+			rates := c.rates(now, now.Add(-30*time.Second))
+			So(rates["1m"], ShouldEqual, 1)
+		})
+
+		Convey("Forget events older than the ring", func() {
+			later := now.Add(20 * time.Minute)
+			c.add(later)
+			So(c.count(later, 15*time.Minute), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestLatencyRing(t *testing.T) {
+	Convey("Latency percentiles", t, func() {
+		now := time.Date(2016, 6, 1, 12, 0, 0, 0, time.UTC)
+		r := &latencyRing{}
+		So(r.percentiles(now), ShouldResemble, Percentiles{})
+
+		for i := 1; i <= 100; i++ {
+			r.add(now, time.Duration(i)*time.Millisecond)
+		}
+
+		p := r.percentiles(now)
+		So(p.P50, ShouldEqual, 50)
+		So(p.P90, ShouldEqual, 90)
+		So(p.P99, ShouldEqual, 99)
+		So(p.Samples, ShouldEqual, 100)
+
+		Convey("Only the latest samples are kept", func() {
+			for i := 0; i < latencySamples; i++ {
+				r.add(now, time.Second)
+			}
+
+			p := r.percentiles(now)
+			So(p.P50, ShouldEqual, 1000)
+			So(p.Samples, ShouldEqual, latencySamples)
+		})
+
+		Convey("Samples older than 15 minutes are dropped", func() {
+			later := now.Add(10 * time.Minute)
+			r.add(later, time.Second)
+
+			p := r.percentiles(later)
+			So(p.Samples, ShouldEqual, 101)
+
+			p = r.percentiles(now.Add(15 * time.Minute))
+			So(p.Samples, ShouldEqual, 1)
+			So(p.P50, ShouldEqual, 1000)
+		})
+	})
+}
@@ -0,0 +1,196 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	schemaCheckFail     = "fail"
+	schemaCheckDegraded = "degraded"
+	schemaCheckOff      = "off"
+
+	schemaColumnsSQL = `
+SELECT table_name, column_name
+FROM information_schema.columns
+WHERE table_schema = ANY(current_schemas(false))
+  AND table_name = ANY($1);`
+)
+
+// SchemaCheckConfig contains configuration for checking the database schema
+// at startup. On a mismatch ibex can fail to start (the default), start in
+// degraded mode until the schema is fixed, or be told not to check at all.
+type SchemaCheckConfig struct {
+	OnMismatch string `json:"on_mismatch"`
+}
+
+func (c SchemaCheckConfig) onMismatch() string {
+	if len(c.OnMismatch) == 0 {
+		return schemaCheckFail
+	}
+
+	return c.OnMismatch
+}
+
+func (c SchemaCheckConfig) validate(errs *ConfigErrors, path string) {
+	switch c.onMismatch() {
+	case schemaCheckFail, schemaCheckDegraded, schemaCheckOff:
+	default:
+		errs.add(path+".on_mismatch", "must be one of %s, %s or %s, got %q",
+			schemaCheckFail, schemaCheckDegraded, schemaCheckOff, c.OnMismatch)
+	}
+}
+
+// requiredColumns lists the columns the queries read, by table. The
+// watermark text columns are only read when textColumns is set.
+func requiredColumns(c SoftDeleteConfig, textColumns bool) map[string][]string {
+	columns := map[string][]string{
+		"pictures":           {"id", "user_id", "event_id", "attachment", "watermark_id"},
+		"events":             {"id", "owner_id"},
+		"photographer_infos": {"id", "user_id", "picture"},
+		"watermarks": {
+			"id", "photographer_info_id", "disabled", "default", "logo", "alpha", "scale",
+			"offset", "position", "updated_at",
+		},
+	}
+
+	if textColumns {
+		columns["watermarks"] = append(columns["watermarks"],
+			"text", "text_font", "text_size", "text_color", "text_alpha", "text_position")
+	}
+
+	if len(c.Pictures) > 0 {
+		columns["pictures"] = append(columns["pictures"], c.Pictures)
+	}
+	if len(c.Events) > 0 {
+		columns["events"] = append(columns["events"], c.Events)
+	}
+	if len(c.Watermarks) > 0 {
+		columns["watermarks"] = append(columns["watermarks"], c.Watermarks)
+	}
+
+	return columns
+}
+
+// schemaMismatch lists the tables and columns the queries need that are
+// missing from the database
+type schemaMismatch struct {
+	missing []string
+}
+
+func (e schemaMismatch) Error() string {
+	return "The database schema doesn't match, missing " + strings.Join(e.missing, ", ")
+}
+
+// checkSchema looks up the columns the queries need in information_schema,
+// returning a schemaMismatch naming every one that's missing
+func (db *DB) checkSchema(ctx context.Context) error {
+	if db.columns == nil {
+		return nil
+	}
+
+	tables := make([]string, 0, len(db.columns))
+	for table := range db.columns {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	rows, err := db.conn.QueryContext(ctx, schemaColumnsSQL, pq.Array(tables))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	found := make(map[string]map[string]bool)
+	for rows.Next() {
+		var table, column string
+		if err = rows.Scan(&table, &column); err != nil {
+			return err
+		}
+		if found[table] == nil {
+			found[table] = make(map[string]bool)
+		}
+		found[table][column] = true
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, table := range tables {
+		if found[table] == nil {
+			missing = append(missing, "table "+table)
+			continue
+		}
+
+		for _, column := range db.columns[table] {
+			if !found[table][column] {
+				missing = append(missing, fmt.Sprintf("column %s.%s", table, column))
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return schemaMismatch{missing}
+	}
+
+	return nil
+}
+
+// startupSchemaCheck checks the schema before the queries are prepared. A
+// mismatch is returned to refuse to start, or puts ibex in degraded mode
+// until the health probe finds the schema fixed. When the database can't be
+// reached to check, ibex starts degraded if degraded mode or a degraded
+// on_mismatch is configured, and otherwise carries on without the check.
+func (db *DB) startupSchemaCheck(c *Config, logger ILogger) error {
+	if db.columns == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), db.queryTimeout)
+	defer cancel()
+
+	err := db.checkSchema(ctx)
+	mismatch, ok := err.(schemaMismatch)
+
+	switch {
+	case err == nil:
+		logger.Info("The database schema matches")
+		return nil
+	case !ok && db.health == nil && c.SchemaCheck.onMismatch() != schemaCheckDegraded:
+		logger.Warn("Couldn't check the database schema: %v", err)
+		return nil
+	case !ok:
+		logger.Warn("Couldn't check the database schema, starting in degraded mode: %v", err)
+	case c.SchemaCheck.onMismatch() == schemaCheckFail:
+		return mismatch
+	default:
+		logger.Warn("%v, starting in degraded mode", mismatch)
+	}
+
+	if db.health == nil {
+		db.health = newDBHealth(c.DegradedMode)
+	}
+	db.health.enter(err)
+
+	return nil
+}
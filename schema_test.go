@@ -0,0 +1,151 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// schemaDriver answers every query with the table and column pairs of
+// information_schema.columns for a schema missing pictures.attachment and
+// the photographer_infos table
+type schemaDriver struct{}
+
+type schemaStmt struct{}
+
+type schemaRows struct {
+	columns [][2]string
+}
+
+func (schemaDriver) Open(string) (driver.Conn, error) { return schemaDriver{}, nil }
+func (schemaDriver) Prepare(string) (driver.Stmt, error) {
+	return schemaStmt{}, nil
+}
+func (schemaDriver) Close() error              { return nil }
+func (schemaDriver) Begin() (driver.Tx, error) { return nil, errors.New("unsupported") }
+
+func (schemaStmt) Close() error  { return nil }
+func (schemaStmt) NumInput() int { return -1 }
+func (schemaStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("unsupported")
+}
+func (schemaStmt) Query([]driver.Value) (driver.Rows, error) {
+	rows := &schemaRows{}
+	for table, columns := range requiredColumns(SoftDeleteConfig{}, true) {
+		for _, column := range columns {
+			if table == "photographer_infos" || (table == "pictures" && column == "attachment") {
+				continue
+			}
+			rows.columns = append(rows.columns, [2]string{table, column})
+		}
+	}
+
+	return rows, nil
+}
+
+func (r *schemaRows) Columns() []string { return []string{"table_name", "column_name"} }
+func (r *schemaRows) Close() error      { return nil }
+func (r *schemaRows) Next(dest []driver.Value) error {
+	if len(r.columns) == 0 {
+		return io.EOF
+	}
+
+	dest[0], dest[1] = r.columns[0][0], r.columns[0][1]
+	r.columns = r.columns[1:]
+
+	return nil
+}
+
+func init() {
+	sql.Register("ibex-schema", schemaDriver{})
+}
+
+func TestSchemaCheck(t *testing.T) {
+	Convey("Checking the schema", t, func() {
+		conn, err := sql.Open("ibex-schema", "")
+		So(err, ShouldBeNil)
+
+		db := &DB{conn: conn, columns: requiredColumns(SoftDeleteConfig{}, true), queryTimeout: time.Second}
+		config := load()
+
+		Convey("Reports everything that's missing", func() {
+			err := db.checkSchema(context.Background())
+			So(err, ShouldHaveSameTypeAs, schemaMismatch{})
+			So(err.(schemaMismatch).missing, ShouldResemble,
+				[]string{"table photographer_infos", "column pictures.attachment"})
+		})
+
+		Convey("Soft-delete columns are required", func() {
+			columns := requiredColumns(SoftDeleteConfig{Events: "deleted_at"}, false)
+			So(columns["events"], ShouldContain, "deleted_at")
+			So(columns["pictures"], ShouldNotContain, "deleted_at")
+		})
+
+		Convey("Text columns are only required with text watermarks", func() {
+			So(requiredColumns(SoftDeleteConfig{}, false)["watermarks"], ShouldNotContain, "text")
+			So(requiredColumns(SoftDeleteConfig{}, true)["watermarks"], ShouldContain, "text_position")
+		})
+
+		Convey("Refuses to start by default", func() {
+			err := db.startupSchemaCheck(config, testLogger{})
+			So(err, ShouldHaveSameTypeAs, schemaMismatch{})
+			So(db.health.isDegraded(), ShouldBeFalse)
+		})
+
+		Convey("Can start degraded", func() {
+			config.SchemaCheck.OnMismatch = schemaCheckDegraded
+			So(db.startupSchemaCheck(config, testLogger{}), ShouldBeNil)
+			So(db.health.isDegraded(), ShouldBeTrue)
+			So(db.healthStatus().LastError, ShouldContainSubstring, "column pictures.attachment")
+		})
+
+		Convey("Starts degraded when the database is down, if configured to", func() {
+			down, err := sql.Open("ibex-down", "")
+			So(err, ShouldBeNil)
+			db.conn = down
+			atomic.StoreInt32(&databaseDown, 1)
+			defer atomic.StoreInt32(&databaseDown, 0)
+
+			So(db.startupSchemaCheck(config, testLogger{}), ShouldBeNil)
+			So(db.health.isDegraded(), ShouldBeFalse)
+
+			db.health = newDBHealth(DegradedModeConfig{Enabled: true})
+			So(db.startupSchemaCheck(config, testLogger{}), ShouldBeNil)
+			So(db.health.isDegraded(), ShouldBeTrue)
+			So(db.healthStatus().LastError, ShouldContainSubstring, "connection refused")
+		})
+
+		Convey("Isn't checked when turned off", func() {
+			db.columns = nil
+			So(db.startupSchemaCheck(config, testLogger{}), ShouldBeNil)
+		})
+
+		Convey("Validates on_mismatch", func() {
+			errs := ConfigErrors{}
+			SchemaCheckConfig{OnMismatch: "explode"}.validate(&errs, "$.schema_check")
+			So(errs, ShouldHaveLength, 1)
+		})
+	})
+}
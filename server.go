@@ -17,10 +17,12 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"reflect"
 	"regexp"
 	"strconv"
 	"time"
@@ -36,44 +38,85 @@ const picturePathFmt = "%s/uploads/%s/picture/attachment/%d/%s"
 
 var pathMatcher *regexp.Regexp
 
+// versionKeys are the version properties that aren't params, so no param
+// can be named after them
+var versionKeys = map[string]bool{
+	"function_name":    true,
+	"name":             true,
+	"watermark":        true,
+	"output":           true,
+	"repeated_params":  true,
+	"watermark_layers": true,
+	"watermark_mode":   true,
+	"watermark_policy": true,
+}
+
+// optionParams are the params ibex handles itself rather than passing
+// straight through to Imagizer, by the kind of value they take
+var optionParams = map[string]reflect.Kind{
+	"only_shrink_larger": reflect.Bool,
+	"gravity":            reflect.String,
+	"background":         reflect.String,
+}
+
 type imagizerHandler struct {
 	imagizerHost    *url.URL
 	config          *Config
-	db              *DB
+	source          PictureInfoSource
 	logger          ILogger
 	statsChan       chan *stat
 	responseTimeout time.Duration
+	renders         *renderCache
+	prefetches      *prefetchPool
+	metrics         *Metrics
 }
 
 func init() {
 	pathMatcher = regexp.MustCompile(re)
 }
 
-// Start initializes and then starts the HTTP server
-func Start(c *Config, logger ILogger, statsChan chan *stat) {
-	db, err := NewDB(c)
-	logger.HandleErr(err)
-
+// Start initializes and then starts the HTTP server, until it's shut down on
+// SIGTERM
+func Start(c *Config, source PictureInfoSource, logger ILogger, statsChan chan *stat, metrics *Metrics, ready *readiness) {
 	imagizerHost, err := url.Parse(c.ImagizerHost)
 	logger.HandleErr(err)
 
 	handler := imagizerHandler{
 		imagizerHost:    imagizerHost,
 		config:          c,
-		db:              db,
+		source:          source,
 		logger:          logger,
 		statsChan:       statsChan,
 		responseTimeout: 20 * time.Second,
+		metrics:         metrics,
+	}
+	if c.DegradedMode.Enabled {
+		handler.renders = newRenderCache(c.DegradedMode)
+	}
+	if len(c.PictureCache.PrefetchSecret) > 0 {
+		handler.prefetches = newPrefetchPool(prefetchWorkers, prefetchQueue)
 	}
 
+	mux := http.NewServeMux()
+	mux.Handle(overlayPath, newOverlayHandler(c, logger))
+	mux.Handle(healthPath, healthHandler{source, logger})
+	mux.Handle(readyPath, readyHandler{ready, logger})
+	mux.Handle("/", handler)
+
 	s := &http.Server{
 		Addr:    c.BindAddr(),
-		Handler: handler,
+		Handler: mux,
 	}
 
+	go ready.drainOnTerm(s, logger)
+
 	logger.Info("Listening on %s", s.Addr)
 	err = s.ListenAndServe()
-	logger.HandleErr(err)
+	if err != http.ErrServerClosed {
+		logger.HandleErr(err)
+	}
+	<-ready.stopped
+	logger.Info("Shut down")
 }
 
 type errorResponse struct {
@@ -107,10 +150,52 @@ type requestInfo struct {
 	info        pictureInfo
 }
 
+// envAndUsername is the env part of the picture's path, which includes the
+// username in development
+func (r requestInfo) envAndUsername() string {
+	if r.env == "development" {
+		return fmt.Sprintf("%s/%s", r.env, r.username)
+	}
+
+	return r.env
+}
+
+// renderKey identifies the picture's render in the renders cache. Anything
+// else in the request path doesn't change the render.
+func (r requestInfo) renderKey() string {
+	return fmt.Sprintf("%s/%d/%s", r.envAndUsername(), r.pictureID, r.versionName)
+}
+
 func (r requestInfo) isPhotographerImage() bool {
 	return r.info.userID == r.info.ownerID
 }
 
+// watermarkDecision applies the version's watermark policy to the picture.
+// Only the event owner's pictures are marked unless the policy says otherwise.
+func (r requestInfo) watermarkDecision() string {
+	if r.isPhotographerImage() {
+		return decisionOwner
+	}
+
+	policy, _ := r.versionInfo["watermark_policy"].(string)
+	switch policy {
+	case policyEveryone:
+		return decisionGuestOwnMark
+	case policyGuestDefaultMark:
+		return decisionGuestDefaultMark
+	case policyGuestOwnerMark:
+		return decisionGuestOwnerMark
+	default:
+		return decisionGuestUnmarked
+	}
+}
+
+// isWatermarked reports whether the requested version is a watermarked one
+func (r requestInfo) isWatermarked() bool {
+	marked, _ := r.versionInfo["watermark"].(bool)
+	return marked
+}
+
 func (h imagizerHandler) handleRequest(ctx context.Context, req *http.Request, w http.ResponseWriter, done chan string, errChan chan errorResponse) {
 	innerCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
@@ -132,7 +217,7 @@ func (h imagizerHandler) handleRequest(ctx context.Context, req *http.Request, w
 		versionName: parts["name"],
 	}
 
-	version, ok := h.config.versionsByName[parts["name"]]
+	version, ok := h.config.version(parts["name"])
 	if !ok {
 		cancel()
 		errChan <- errorResponse{fmt.Errorf("Version not found with name %s", parts["name"]), http.StatusNotFound}
@@ -150,22 +235,76 @@ func (h imagizerHandler) handleRequest(ctx context.Context, req *http.Request, w
 	}
 	rinfo.pictureID = pictureID
 
-	info, err := h.db.loadPictureInfo(ctx, rinfo.pictureID)
+	lookupStarted := time.Now()
+	info, err := h.source.loadPictureInfo(ctx, rinfo.pictureID)
+	h.metrics.stage(stageDB, time.Since(lookupStarted))
 	if err != nil {
-		cancel()
 		var status int
 
 		switch err.(type) {
 		case noRowsErr:
 			status = http.StatusNotFound
 		default:
+			if h.serveCachedRender(w, rinfo, logger, err) {
+				done <- parts["name"]
+				return
+			}
 			status = http.StatusInternalServerError
+			if err == errDegraded {
+				status = http.StatusServiceUnavailable
+			}
 		}
 
+		cancel()
 		errChan <- errorResponse{err, status}
 		return
 	}
+	if info.deleted {
+		logger.Info("Picture %d is deleted", rinfo.pictureID)
+		setGoneHeaders(w.Header())
+		if h.renders != nil {
+			h.renders.dropPicture(rinfo.pictureID)
+		}
+		cancel()
+		errChan <- errorResponse{fmt.Errorf("Picture %d has been deleted", rinfo.pictureID), http.StatusGone}
+		return
+	}
 	rinfo.info = info
+	if info.stale {
+		logger.Warn("Serving stale info for picture %d", rinfo.pictureID)
+		w.Header().Set(degradedHeader, degradedStaleMetadata)
+	}
+
+	if rinfo.isWatermarked() {
+		decision := rinfo.watermarkDecision()
+		logger.Debug("Watermark decision for picture %d by user %d (owner %d): %s",
+			rinfo.pictureID, info.userID, info.ownerID, decision)
+		sendStat(h.statsChan, &stat{T: StatWatermarkDecision, Payload: decision})
+
+		switch decision {
+		case decisionGuestDefaultMark:
+			rinfo.info.mark = watermark{}
+			rinfo.info.oldMark = sql.NullString{}
+		case decisionGuestOwnerMark:
+			lookupStarted = time.Now()
+			om, err := h.source.loadOwnerMark(ctx, info.ownerID)
+			h.metrics.stage(stageDB, time.Since(lookupStarted))
+			if err != nil {
+				if h.serveCachedRender(w, rinfo, logger, err) {
+					done <- parts["name"]
+					return
+				}
+
+				cancel()
+				errChan <- errorResponse{err, http.StatusInternalServerError}
+				return
+			}
+
+			rinfo.info.photographerInfoID = om.photographerInfoID
+			rinfo.info.oldMark = om.oldMark
+			rinfo.info.mark = om.mark
+		}
+	}
 
 	proxy, err := h.imagizerURL(innerCtx, rinfo)
 	if err != nil {
@@ -183,7 +322,12 @@ func (h imagizerHandler) handleRequest(ctx context.Context, req *http.Request, w
 	}
 	imagizerReq = imagizerReq.WithContext(innerCtx)
 
+	imagizerFinished := h.metrics.imagizerStarted()
+	defer imagizerFinished()
+
+	imagizerStarted := time.Now()
 	resp, err := http.DefaultClient.Do(imagizerReq)
+	h.metrics.stage(stageImagizer, time.Since(imagizerStarted))
 	if err != nil {
 		cancel()
 		errChan <- errorResponse{err, http.StatusInternalServerError}
@@ -191,49 +335,93 @@ func (h imagizerHandler) handleRequest(ctx context.Context, req *http.Request, w
 	}
 	logger.Debug("Imagizer response: %+v", resp)
 
-	_, err = io.Copy(w, resp.Body)
+	var body io.Reader = resp.Body
+	var render *cappedBuffer
+	if h.renders != nil && resp.StatusCode == http.StatusOK {
+		render = &cappedBuffer{max: h.renders.maxEntry}
+		body = io.TeeReader(resp.Body, render)
+	}
+
+	copyStarted := time.Now()
+	n, err := io.Copy(w, body)
+	h.metrics.stage(stageCopy, time.Since(copyStarted))
+	h.metrics.served(rinfo.versionName, n)
 	if err != nil {
 		cancel()
 		errChan <- errorResponse{err, http.StatusInternalServerError}
 		return
 	}
 
+	if render != nil && !render.overflow {
+		h.renders.put(rinfo.renderKey(), rinfo.pictureID, render.buf)
+	}
+
 	started := innerCtx.Value("startTime").(time.Time)
 	logger.Info(fmt.Sprintf("FINISH [GET] %s (%s)", req.URL.Path, time.Since(started)))
 	done <- parts["name"]
 }
 
+// serveCachedRender answers the request with the last render of the same
+// picture and version, if there is one, when its info can't be loaded
+func (h imagizerHandler) serveCachedRender(w http.ResponseWriter, rinfo requestInfo, logger ILogger, err error) bool {
+	if h.renders == nil {
+		return false
+	}
+
+	body, ok := h.renders.get(rinfo.renderKey())
+	if !ok {
+		return false
+	}
+
+	logger.Warn("Serving a cached render of %s: %v", rinfo.renderKey(), err)
+	w.Header().Set(degradedHeader, degradedCachedRender)
+	_, _ = w.Write(body)
+	return true
+}
+
 func (h imagizerHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), h.responseTimeout)
 	innerLogger := h.logger.Sub()
 	innerLogger.SetPrefix(fmt.Sprintf("[%s]", uuid.NewV4().String()))
 	ctx = context.WithValue(ctx, "logger", innerLogger)
-	ctx = context.WithValue(ctx, "startTime", time.Now())
+	started := time.Now()
+	ctx = context.WithValue(ctx, "startTime", started)
 	defer cancel()
 	req = req.WithContext(ctx)
 
+	finished := h.metrics.requestStarted()
+	defer finished()
+
+	status := http.StatusOK
+	version, env := requestLabels(h.config, req.URL.Path)
+	defer func() { h.metrics.request(version, env, status, time.Since(started)) }()
+
+	h.prefetchHint(req, innerLogger)
+
 	done := make(chan string)
 	errChan := make(chan errorResponse)
 	go h.handleRequest(ctx, req, w, done, errChan)
 
 	handleTimeout := func(err string) {
+		status = http.StatusGatewayTimeout
 		innerLogger.Warn("timeout: %s", err)
 		http.Error(w, "timeout", http.StatusGatewayTimeout)
-		h.statsChan <- &stat{StatTimeout, ""}
+		sendStat(h.statsChan, &stat{T: StatTimeout, Payload: version, Env: env, Status: status})
 	}
 
 	select {
 	case name := <-done:
 		cancel()
-		h.statsChan <- &stat{StatServedPicture, name}
+		sendStat(h.statsChan, &stat{T: StatServedPicture, Payload: name, Latency: time.Since(started), Env: env, Status: status})
 	case errResp := <-errChan:
 		if errResp.err == context.DeadlineExceeded || errResp.err == context.Canceled {
 			handleTimeout(errResp.err.Error())
 			return
 		}
 
+		status = errResp.status
 		http.Error(w, errResp.err.Error(), errResp.status)
-		h.statsChan <- &stat{StatBadRequest, ""}
+		sendStat(h.statsChan, &stat{T: StatBadRequest, Payload: version, Env: env, Status: status})
 	case <-ctx.Done():
 		handleTimeout(ctx.Err().Error())
 	}
@@ -242,51 +430,36 @@ func (h imagizerHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 func (h imagizerHandler) imagizerURL(ctx context.Context, rinfo requestInfo) (url.URL, error) {
 	vals := url.Values{}
 	retURL := url.URL{}
+	repeated, _ := rinfo.versionInfo["repeated_params"].(map[string]bool)
 
 	for key, val := range rinfo.versionInfo {
 		if key == "watermark" && val == true {
-			if rinfo.isPhotographerImage() {
-				wm := h.getCanonicalWatermark(rinfo)
-
-				vals.Add("mark", wm.logo.String)
-				if wm.scale.Valid {
-					vals.Add("mark_scale", strconv.FormatInt(wm.scale.Int64, 10))
-				} else {
-
-					vals.Add("mark_scale", "0")
-				}
-				if wm.offset.Valid {
-					vals.Add("mark_offset", strconv.FormatInt(wm.offset.Int64, 10))
-				} else {
-					vals.Add("mark_offset", "0")
-				}
-				if wm.alpha.Valid {
-					vals.Add("mark_alpha", strconv.FormatInt(wm.alpha.Int64, 10))
-				} else {
-					vals.Add("mark_alpha", "0")
-				}
-				vals.Add("mark_pos", wm.position.String)
+			if rinfo.watermarkDecision() != decisionGuestUnmarked {
+				mode, _ := rinfo.versionInfo["watermark_mode"].(string)
+				layers := h.applyWatermarkMode(mode, h.watermarkLayers(rinfo))
+				addWatermarkLayerParams(vals, layers)
 			}
 
 			continue
 		}
 
-		if key == "function_name" || key == "name" || key == "only_shrink_larger" {
-			continue
+		if param, ok := val.(paramValue); ok {
+			param.encode(vals, key, repeated)
 		}
+	}
 
-		switch val := val.(type) {
-		default:
-			return retURL, fmt.Errorf("Unexpected type %T for %+v", val, val)
-		case string:
-			vals.Add(key, val)
-		case int:
-			vals.Add(key, strconv.Itoa(val))
-		case float64:
-			vals.Add(key, strconv.Itoa(int(val)))
-		case bool:
-			vals.Add(key, fmt.Sprintf("%t", val))
-		}
+	output, _ := rinfo.versionInfo["output"].(url.Values)
+	for key, val := range output {
+		vals[key] = val
+	}
+
+	functionName, _ := rinfo.versionInfo["function_name"].(string)
+	processing, err := processingParams(functionName, rinfo.versionInfo)
+	if err != nil {
+		return retURL, err
+	}
+	for key, val := range processing {
+		vals[key] = val
 	}
 
 	path, err := h.pathForImage(ctx, rinfo)
@@ -307,7 +480,7 @@ func (h imagizerHandler) getCanonicalWatermark(rinfo requestInfo) watermark {
 
 	if !wm.logo.Valid {
 		wm = watermark{
-			logo:     newNullString("https://www.snapshots.com/images/icon.png"),
+			logo:     newNullString(defaultWatermarkLogo),
 			disabled: newNullBool(false),
 			alpha:    newNullInt64(70),
 			scale:    newNullInt64(15),
@@ -332,16 +505,8 @@ func (h imagizerHandler) getCanonicalWatermark(rinfo requestInfo) watermark {
 }
 
 func (h imagizerHandler) pathForImage(ctx context.Context, rinfo requestInfo) (string, error) {
-	var envAndUsername string
-
-	if rinfo.env == "development" {
-		envAndUsername = fmt.Sprintf("%s/%s", rinfo.env, rinfo.username)
-	} else {
-		envAndUsername = rinfo.env
-	}
-
 	path := fmt.Sprintf(picturePathFmt,
-		BucketNames[rinfo.env], envAndUsername, rinfo.pictureID, rinfo.info.attachment)
+		BucketNames[rinfo.env], rinfo.envAndUsername(), rinfo.pictureID, rinfo.info.attachment)
 	return path, nil
 }
 
@@ -42,7 +42,8 @@ func TestPathMatching(t *testing.T) {
 
 		Convey("Handling path recognition", withImagizerTestServer(hf, func(server *httptest.Server) {
 			imagizerHost, _ := url.Parse(server.URL)
-			handler := imagizerHandler{imagizerHost, config, db, logger, NewBlackHole(), 1 * time.Second}
+			handler := imagizerHandler{imagizerHost: imagizerHost, config: config, source: db, logger: logger,
+				statsChan: NewBlackHole(), responseTimeout: 1 * time.Second}
 
 			badReqs := []*http.Request{
 				httptest.NewRequest("GET", "/foo", nil),
@@ -96,7 +97,8 @@ func TestConnectionTimeouts(t *testing.T) {
 		Convey("Do not hang forever", withImagizerTestServer(hf, func(server *httptest.Server) {
 			imagizerHost, _ := url.Parse(server.URL)
 
-			handler := imagizerHandler{imagizerHost, config, db, logger, NewBlackHole(), 50 * time.Millisecond}
+			handler := imagizerHandler{imagizerHost: imagizerHost, config: config, source: db, logger: logger,
+				statsChan: NewBlackHole(), responseTimeout: 50 * time.Millisecond}
 			req := httptest.NewRequest("GET", "/uploads/staging/picture/attachment/1/thumb/3", nil)
 			w := httptest.NewRecorder()
 			handler.ServeHTTP(w, req)
@@ -106,3 +108,13 @@ func TestConnectionTimeouts(t *testing.T) {
 		}))
 	}))
 }
+
+func TestRenderKey(t *testing.T) {
+	Convey("Render cache keys", t, func() {
+		rinfo := requestInfo{pictureID: 1, env: "staging", username: "jlindsey", versionName: "thumb"}
+		So(rinfo.renderKey(), ShouldEqual, "staging/1/thumb")
+
+		rinfo.env = "development"
+		So(rinfo.renderKey(), ShouldEqual, "development/jlindsey/1/thumb")
+	})
+}
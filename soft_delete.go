@@ -0,0 +1,111 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+var columnNameMatcher = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// goneHeaders are sent with a deleted picture's 410, so browsers and CDNs
+// drop any copy they kept
+var goneHeaders = map[string]string{
+	"Cache-Control":     "no-store, no-cache, must-revalidate, max-age=0",
+	"Surrogate-Control": "no-store",
+	"CDN-Cache-Control": "no-store",
+	"Pragma":            "no-cache",
+	"Expires":           "0",
+}
+
+// SoftDeleteConfig names the columns that mark pictures, events and
+// watermarks as deleted, like Rails' deleted_at. A row is deleted once its
+// column is set, and tables without a column are never deleted.
+type SoftDeleteConfig struct {
+	Pictures   string `json:"pictures"`
+	Events     string `json:"events"`
+	Watermarks string `json:"watermarks"`
+}
+
+func (c SoftDeleteConfig) validate(errs *ConfigErrors, path string) {
+	columns := []struct{ key, column string }{
+		{"pictures", c.Pictures},
+		{"events", c.Events},
+		{"watermarks", c.Watermarks},
+	}
+
+	for _, col := range columns {
+		if len(col.column) > 0 && !columnNameMatcher.MatchString(col.column) {
+			errs.add(path+"."+col.key, "must be a column name, got %q", col.column)
+		}
+	}
+}
+
+// deletedSQL selects whether a picture or its event is deleted
+func (c SoftDeleteConfig) deletedSQL() string {
+	var deleted []string
+	if len(c.Pictures) > 0 {
+		deleted = append(deleted, "pictures."+pq.QuoteIdentifier(c.Pictures)+" IS NOT NULL")
+	}
+	if len(c.Events) > 0 {
+		deleted = append(deleted, "events."+pq.QuoteIdentifier(c.Events)+" IS NOT NULL")
+	}
+
+	if len(deleted) == 0 {
+		return "FALSE"
+	}
+
+	return "(" + strings.Join(deleted, " OR ") + ")"
+}
+
+// liveWatermarkSQL is the join condition leaving deleted watermarks out, so
+// pictures fall back to having no mark rather than being gone
+func (c SoftDeleteConfig) liveWatermarkSQL() string {
+	if len(c.Watermarks) == 0 {
+		return ""
+	}
+
+	return "\n  AND watermarks." + pq.QuoteIdentifier(c.Watermarks) + " IS NULL"
+}
+
+// queries builds the picture and owner mark queries for the configured
+// columns, reading the watermark text columns only when textColumns is set
+func (c SoftDeleteConfig) queries(textColumns bool) queries {
+	deleted, liveMark := c.deletedSQL(), c.liveWatermarkSQL()
+	text := watermarkNoTextColumns
+	if textColumns {
+		text = watermarkTextColumns
+	}
+
+	return queries{
+		picture:    fmt.Sprintf(querySQL, deleted, liveMark, text),
+		batch:      fmt.Sprintf(batchQuerySQL, deleted, liveMark, text),
+		neighbours: fmt.Sprintf(neighboursSQL, deleted, liveMark, text),
+		ownerMark:  fmt.Sprintf(ownerMarkSQL, liveMark, text),
+	}
+}
+
+// setGoneHeaders adds goneHeaders to h
+func setGoneHeaders(h http.Header) {
+	for k, v := range goneHeaders {
+		h.Set(k, v)
+	}
+}
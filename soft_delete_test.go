@@ -0,0 +1,92 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSoftDeleteQueries(t *testing.T) {
+	Convey("Soft-delete queries", t, func() {
+		Convey("Nothing is deleted without columns", func() {
+			q := SoftDeleteConfig{}.queries(false)
+			So(q.picture, ShouldContainSubstring, "watermarks.position,\n  NULL, NULL, NULL, NULL, NULL, NULL, FALSE, pictures.id")
+			So(q.picture, ShouldContainSubstring, "watermarks.id = pictures.watermark_id\n")
+			So(q.ownerMark, ShouldContainSubstring, "watermarks.\"default\"\nWHERE")
+			So(q.picture, ShouldNotContainSubstring, "%!")
+			So(q.ownerMark, ShouldNotContainSubstring, "%!")
+		})
+
+		Convey("Configured columns are checked", func() {
+			q := SoftDeleteConfig{Pictures: "deleted_at", Events: "removed_at", Watermarks: "deleted_at"}.queries(false)
+			So(q.picture, ShouldContainSubstring,
+				`(pictures."deleted_at" IS NOT NULL OR events."removed_at" IS NOT NULL), pictures.id`)
+			So(q.batch, ShouldContainSubstring, `AND watermarks."deleted_at" IS NULL`)
+			So(q.neighbours, ShouldContainSubstring, `AND watermarks."deleted_at" IS NULL`)
+			So(q.ownerMark, ShouldContainSubstring, `AND watermarks."deleted_at" IS NULL`)
+			So(q.picture, ShouldNotContainSubstring, "%!")
+		})
+
+		Convey("Text columns are read once they exist", func() {
+			q := SoftDeleteConfig{}.queries(true)
+			So(q.picture, ShouldContainSubstring, "watermarks.text_position, FALSE, pictures.id")
+			So(q.ownerMark, ShouldContainSubstring, "watermarks.text_position\nFROM")
+			So(q.ownerMark, ShouldNotContainSubstring, watermarkNoTextColumns)
+			So(q.ownerMark, ShouldNotContainSubstring, "%!")
+		})
+
+		Convey("Column names are validated", func() {
+			errs := ConfigErrors{}
+			SoftDeleteConfig{Pictures: "deleted_at", Events: "deleted_at; drop table events"}.validate(&errs, "$.soft_delete")
+			So(errs, ShouldHaveLength, 1)
+			So(errs[0].Path, ShouldEqual, "$.soft_delete.events")
+		})
+	})
+}
+
+func TestDeletedPictures(t *testing.T) {
+	Convey("Deleted pictures", t, func() {
+		source, err := loadFileSource(path.Join("test_resources", "pictures.ndjson"))
+		So(err, ShouldBeNil)
+
+		imagizerHost, _ := url.Parse("http://imagizer.test")
+		handler := imagizerHandler{imagizerHost: imagizerHost, config: load(), source: source, logger: testLogger{},
+			statsChan: NewBlackHole(), responseTimeout: time.Second, renders: newRenderCache(DegradedModeConfig{})}
+
+		handler.renders.put("staging/4/thumb", 4, []byte("cached jpeg"))
+		handler.renders.put("staging/4/large", 4, []byte("cached jpeg"))
+		handler.renders.put("staging/1/thumb", 1, []byte("cached jpeg"))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/uploads/staging/picture/attachment/4/thumb", nil))
+		So(w.Code, ShouldEqual, 410)
+		So(w.Header().Get("Cache-Control"), ShouldContainSubstring, "no-store")
+		So(w.Header().Get("Surrogate-Control"), ShouldEqual, "no-store")
+
+		_, ok := handler.renders.get("staging/4/thumb")
+		So(ok, ShouldBeFalse)
+		_, ok = handler.renders.get("staging/4/large")
+		So(ok, ShouldBeFalse)
+		_, ok = handler.renders.get("staging/1/thumb")
+		So(ok, ShouldBeTrue)
+	})
+}
@@ -0,0 +1,351 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	sourcePostgres = "postgres"
+	sourceHTTP     = "http"
+	sourceFile     = "file"
+
+	recordPicture = "picture"
+	recordOwner   = "owner"
+
+	defaultSourceTimeoutMilli = 2000
+)
+
+// PictureInfoSource loads the picture info and owner watermarks that decide
+// how a picture is rendered
+type PictureInfoSource interface {
+	loadPictureInfo(ctx context.Context, id int) (pictureInfo, error)
+	loadOwnerMark(ctx context.Context, ownerID int) (ownerMark, error)
+}
+
+// SourceConfig selects where picture info comes from: postgres (the default)
+// queries database_url, http asks the Rails JSON API at url and file reads
+// a JSON or NDJSON file at path
+type SourceConfig struct {
+	Type          string `json:"type"`
+	URL           string `json:"url"`
+	Token         string `json:"token" secret:"true"`
+	Path          string `json:"path"`
+	TimeoutMillis int    `json:"timeout_ms"`
+}
+
+func (c SourceConfig) kind() string {
+	if len(c.Type) == 0 {
+		return sourcePostgres
+	}
+
+	return c.Type
+}
+
+func (c SourceConfig) timeout() time.Duration {
+	if c.TimeoutMillis == 0 {
+		return defaultSourceTimeoutMilli * time.Millisecond
+	}
+
+	return time.Duration(c.TimeoutMillis) * time.Millisecond
+}
+
+func (c SourceConfig) validate(errs *ConfigErrors, path string) {
+	switch c.kind() {
+	case sourcePostgres:
+	case sourceHTTP:
+		validateURL(errs, path+".url", c.URL, "http", "https")
+	case sourceFile:
+		if len(c.Path) == 0 {
+			errs.add(path+".path", "is required")
+		}
+	default:
+		errs.add(path+".type", "unknown source %q, expected %s, %s or %s",
+			c.Type, sourcePostgres, sourceHTTP, sourceFile)
+	}
+
+	if c.TimeoutMillis < 0 {
+		errs.add(path+".timeout_ms", "must not be negative, got %d", c.TimeoutMillis)
+	}
+}
+
+// newPictureInfoSource creates the source the config selects
+func newPictureInfoSource(c *Config) (PictureInfoSource, error) {
+	switch c.Source.kind() {
+	case sourceHTTP:
+		return newHTTPSource(c.Source), nil
+	case sourceFile:
+		return loadFileSource(c.Source.Path)
+	default:
+		return NewDB(c)
+	}
+}
+
+// sourceWatermark is a watermark as the JSON sources send it. Missing fields
+// are NULL, like their columns.
+type sourceWatermark struct {
+	ID           *int64  `json:"id"`
+	Disabled     *bool   `json:"disabled"`
+	Logo         *string `json:"logo"`
+	Alpha        *int64  `json:"alpha"`
+	Scale        *int64  `json:"scale"`
+	Offset       *int64  `json:"offset"`
+	Position     *string `json:"position"`
+	Text         *string `json:"text"`
+	TextFont     *string `json:"text_font"`
+	TextSize     *int64  `json:"text_size"`
+	TextColor    *string `json:"text_color"`
+	TextAlpha    *int64  `json:"text_alpha"`
+	TextPosition *string `json:"text_position"`
+}
+
+// sourceRecord is a picture, or with type owner an owner's default
+// watermark keyed by their user id, as the JSON sources send them
+type sourceRecord struct {
+	Type                string           `json:"type,omitempty"`
+	ID                  int              `json:"id"`
+	UserID              int              `json:"user_id"`
+	Attachment          string           `json:"attachment"`
+	OwnerID             int              `json:"owner_id"`
+	PhotographerInfoID  *int64           `json:"photographer_info_id"`
+	PhotographerPicture *string          `json:"photographer_picture"`
+	Watermark           *sourceWatermark `json:"watermark"`
+	Deleted             bool             `json:"deleted,omitempty"`
+}
+
+func nullInt64From(i *int64) sql.NullInt64 {
+	if i == nil {
+		return sql.NullInt64{}
+	}
+
+	return newNullInt64(*i)
+}
+
+func nullStringFrom(s *string) sql.NullString {
+	if s == nil {
+		return sql.NullString{}
+	}
+
+	return sql.NullString{Valid: true, String: *s}
+}
+
+func nullBoolFrom(b *bool) sql.NullBool {
+	if b == nil {
+		return sql.NullBool{}
+	}
+
+	return newNullBool(*b)
+}
+
+func (w *sourceWatermark) watermark() watermark {
+	if w == nil {
+		return watermark{}
+	}
+
+	wm := watermark{
+		id:           nullInt64From(w.ID),
+		disabled:     nullBoolFrom(w.Disabled),
+		logo:         nullStringFrom(w.Logo),
+		alpha:        nullInt64From(w.Alpha),
+		scale:        nullInt64From(w.Scale),
+		offset:       nullInt64From(w.Offset),
+		position:     nullStringFrom(w.Position),
+		text:         nullStringFrom(w.Text),
+		textFont:     nullStringFrom(w.TextFont),
+		textSize:     nullInt64From(w.TextSize),
+		textColor:    nullStringFrom(w.TextColor),
+		textAlpha:    nullInt64From(w.TextAlpha),
+		textPosition: nullStringFrom(w.TextPosition),
+	}
+	wm.mungePosition()
+
+	return wm
+}
+
+func (r sourceRecord) pictureInfo() pictureInfo {
+	return pictureInfo{
+		userID:             r.UserID,
+		attachment:         r.Attachment,
+		ownerID:            r.OwnerID,
+		photographerInfoID: nullInt64From(r.PhotographerInfoID),
+		oldMark:            nullStringFrom(r.PhotographerPicture),
+		mark:               r.Watermark.watermark(),
+		deleted:            r.Deleted,
+	}
+}
+
+func (r sourceRecord) ownerMark() ownerMark {
+	return ownerMark{
+		photographerInfoID: nullInt64From(r.PhotographerInfoID),
+		oldMark:            nullStringFrom(r.PhotographerPicture),
+		mark:               r.Watermark.watermark(),
+	}
+}
+
+// httpSource loads picture info from the Rails JSON API, at
+// <url>/pictures/<id> and <url>/owners/<user id>/watermark
+type httpSource struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func newHTTPSource(c SourceConfig) *httpSource {
+	return &httpSource{
+		baseURL: strings.TrimRight(c.URL, "/"),
+		token:   c.Token,
+		client:  &http.Client{Timeout: c.timeout()},
+	}
+}
+
+// get fetches path into record, returning false when it's not found
+func (s *httpSource) get(ctx context.Context, path string, record *sourceRecord) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, s.baseURL+path, nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if len(s.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, fmt.Errorf("context timeout: %+v", ctx.Err())
+		}
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, json.NewDecoder(resp.Body).Decode(record)
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("Picture info API returned %s for %s", resp.Status, path)
+	}
+}
+
+func (s *httpSource) loadPictureInfo(ctx context.Context, id int) (pictureInfo, error) {
+	var record sourceRecord
+	found, err := s.get(ctx, fmt.Sprintf("/pictures/%d", id), &record)
+
+	switch {
+	case err != nil:
+		return pictureInfo{}, err
+	case !found:
+		return pictureInfo{}, newNoRowsError("No picture found with id %d", id)
+	default:
+		return record.pictureInfo(), nil
+	}
+}
+
+func (s *httpSource) loadOwnerMark(ctx context.Context, ownerID int) (ownerMark, error) {
+	var record sourceRecord
+	found, err := s.get(ctx, fmt.Sprintf("/owners/%d/watermark", ownerID), &record)
+
+	switch {
+	case err != nil:
+		return ownerMark{}, err
+	case !found:
+		return ownerMark{}, nil
+	default:
+		return record.ownerMark(), nil
+	}
+}
+
+// fileSource serves picture info from a static file, for offline development
+// and tests. A .ndjson or .jsonl file has a record per line, anything else
+// is read as a JSON array of records.
+type fileSource struct {
+	pictures map[int]pictureInfo
+	owners   map[int]ownerMark
+}
+
+func loadFileSource(path string) (*fileSource, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []sourceRecord
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ndjson", ".jsonl":
+		scanner := bufio.NewScanner(bytes.NewReader(buf))
+		for line := 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+
+			var record sourceRecord
+			if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+			}
+			records = append(records, record)
+		}
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	default:
+		if err = json.Unmarshal(buf, &records); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	s := &fileSource{
+		pictures: make(map[int]pictureInfo),
+		owners:   make(map[int]ownerMark),
+	}
+	for _, record := range records {
+		switch record.Type {
+		case "", recordPicture:
+			s.pictures[record.ID] = record.pictureInfo()
+		case recordOwner:
+			s.owners[record.ID] = record.ownerMark()
+		default:
+			return nil, fmt.Errorf("%s: unknown record type %q", path, record.Type)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *fileSource) loadPictureInfo(ctx context.Context, id int) (pictureInfo, error) {
+	info, ok := s.pictures[id]
+	if !ok {
+		return pictureInfo{}, newNoRowsError("No picture found with id %d", id)
+	}
+
+	return info, nil
+}
+
+func (s *fileSource) loadOwnerMark(ctx context.Context, ownerID int) (ownerMark, error) {
+	return s.owners[ownerID], nil
+}
@@ -0,0 +1,140 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFileSource(t *testing.T) {
+	Convey("Loading picture info from a file", t, func() {
+		ctx := context.Background()
+
+		Convey("Reads NDJSON records", func() {
+			source, err := loadFileSource(path.Join("test_resources", "pictures.ndjson"))
+			So(err, ShouldBeNil)
+
+			info, err := source.loadPictureInfo(ctx, 1)
+			So(err, ShouldBeNil)
+			So(info.attachment, ShouldEqual, "test_pic.jpg")
+			So(info.mark.alpha.Int64, ShouldEqual, 70)
+			So(info.mark.position.String, ShouldEqual, "bottom,left")
+			So(info.mark.text.Valid, ShouldBeFalse)
+
+			info, err = source.loadPictureInfo(ctx, 3)
+			So(err, ShouldBeNil)
+			So(info.mark.logo.Valid, ShouldBeFalse)
+			So(info.mark.textSize.Int64, ShouldEqual, 32)
+
+			_, err = source.loadPictureInfo(ctx, 42)
+			So(err, ShouldHaveSameTypeAs, noRowsErr{})
+
+			om, err := source.loadOwnerMark(ctx, 1)
+			So(err, ShouldBeNil)
+			So(om.mark.id.Int64, ShouldEqual, 1)
+
+			om, err = source.loadOwnerMark(ctx, 42)
+			So(err, ShouldBeNil)
+			So(om.mark.id.Valid, ShouldBeFalse)
+		})
+
+		Convey("Reads a JSON array", func() {
+			source, err := loadFileSource(path.Join("test_resources", "pictures.json"))
+			So(err, ShouldBeNil)
+
+			info, err := source.loadPictureInfo(ctx, 1)
+			So(err, ShouldBeNil)
+			So(info.ownerID, ShouldEqual, 1)
+			So(info.mark.id.Valid, ShouldBeFalse)
+		})
+	})
+}
+
+func TestHTTPSource(t *testing.T) {
+	Convey("Loading picture info from the API", t, func() {
+		ctx := context.Background()
+		var auth string
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth = r.Header.Get("Authorization")
+
+			switch r.URL.Path {
+			case "/api/pictures/1":
+				fmt.Fprint(w, `{"id": 1, "user_id": 2, "attachment": "pic.jpg", "owner_id": 1,
+					"watermark": {"id": 4, "alpha": 20, "position": "top,right"}}`)
+			case "/api/owners/1/watermark":
+				fmt.Fprint(w, `{"type": "owner", "id": 1, "photographer_info_id": 3}`)
+			case "/api/pictures/500":
+				http.Error(w, "boom", http.StatusInternalServerError)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		defer server.Close()
+
+		source := newHTTPSource(SourceConfig{URL: server.URL + "/api/", Token: "s3cret"})
+
+		info, err := source.loadPictureInfo(ctx, 1)
+		So(err, ShouldBeNil)
+		So(auth, ShouldEqual, "Bearer s3cret")
+		So(info.userID, ShouldEqual, 2)
+		So(info.mark.alpha.Int64, ShouldEqual, 20)
+		So(info.mark.position.String, ShouldEqual, "top,right")
+
+		_, err = source.loadPictureInfo(ctx, 42)
+		So(err, ShouldHaveSameTypeAs, noRowsErr{})
+
+		_, err = source.loadPictureInfo(ctx, 500)
+		So(err, ShouldNotBeNil)
+		So(err, ShouldNotHaveSameTypeAs, noRowsErr{})
+
+		om, err := source.loadOwnerMark(ctx, 1)
+		So(err, ShouldBeNil)
+		So(om.photographerInfoID.Int64, ShouldEqual, 3)
+
+		om, err = source.loadOwnerMark(ctx, 42)
+		So(err, ShouldBeNil)
+		So(om.photographerInfoID.Valid, ShouldBeFalse)
+	})
+}
+
+func TestSourceConfig(t *testing.T) {
+	Convey("Picking a picture info source", t, func() {
+		config := load()
+		config.DatabaseURL = ""
+		config.Source = SourceConfig{Type: sourceFile, Path: path.Join("test_resources", "pictures.ndjson")}
+		So(config.Validate(), ShouldBeNil)
+
+		source, err := newPictureInfoSource(config)
+		So(err, ShouldBeNil)
+		So(source, ShouldHaveSameTypeAs, &fileSource{})
+
+		config.Source = SourceConfig{Type: sourceHTTP}
+		err = config.Validate()
+		So(err, ShouldNotBeNil)
+		So(err.(ConfigErrors)[0].Path, ShouldEqual, "$.source.url")
+
+		config.Source = SourceConfig{Type: "redis"}
+		So(config.Validate(), ShouldNotBeNil)
+	})
+}
@@ -16,12 +16,23 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// statsBuffer is how many stats can wait for Listen before new ones are
+// dropped
+const statsBuffer = 1000
+
+// droppedStats counts the stats dropped because Listen fell behind
+var droppedStats uint64
+
 type configHandler struct {
 	config *Config
 	logger ILogger
@@ -33,14 +44,44 @@ func (h configHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	h.logger.Debug("Request for /config")
 
-	body, err := json.Marshal(h.config)
+	marshal := redactedJSON
+	if len(req.URL.Query().Get("full")) > 0 {
+		if status := h.authorizeAdmin(req); status != http.StatusOK {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ibex"`)
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+
+		h.logger.Info("Full config dump for %s", req.RemoteAddr)
+		marshal = json.Marshal
+	}
+
+	h.config.mu.RLock()
+	body, err := marshal(h.config)
+	h.config.mu.RUnlock()
 
 	if err != nil {
 		http.Error(w, fmt.Sprintf("ERROR: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	fmt.Fprintf(w, string(body[:]))
+	_, _ = w.Write(body)
+}
+
+// authorizeAdmin checks the request's bearer token against the configured
+// admin token. Full dumps are disabled when no token is configured.
+func (h configHandler) authorizeAdmin(req *http.Request) int {
+	token := h.config.StatsServer.AdminToken
+	if len(token) == 0 {
+		return http.StatusForbidden
+	}
+
+	given := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		return http.StatusUnauthorized
+	}
+
+	return http.StatusOK
 }
 
 type statType int
@@ -52,22 +93,85 @@ const (
 	StatTimeout
 	// StatServedPicture is a const for the BadRequest stat
 	StatServedPicture
+	// StatWatermarkDecision is a const for the watermark policy decision stat
+	StatWatermarkDecision
 )
 
+// stat is a server event. Payload is the version of the request, or the
+// decision of a StatWatermarkDecision, which has no env or status.
 type stat struct {
 	T       statType
 	Payload string
+	Latency time.Duration
+	Env     string
+	Status  int
+}
+
+// sendStat sends st without waiting, so a slow Listen never holds up a
+// response. Stats that don't fit in the buffer are dropped and counted.
+func sendStat(ch chan *stat, st *stat) {
+	select {
+	case ch <- st:
+	default:
+		atomic.AddUint64(&droppedStats, 1)
+	}
+}
+
+// StatsSink receives the server's stats. Record is called from a single
+// goroutine and must not block.
+type StatsSink interface {
+	Record(st *stat)
+}
+
+// newStatsChan returns the chan the server sends its stats to, passing each
+// of them on to every sink
+func newStatsChan(sinks ...StatsSink) chan *stat {
+	if len(sinks) == 0 {
+		return NewBlackHole()
+	}
+
+	ch := make(chan *stat, statsBuffer)
+	go func() {
+		for st := range ch {
+			for _, sink := range sinks {
+				sink.Record(st)
+			}
+		}
+	}()
+
+	return ch
 }
 
-// Stats serves as a receiver of server statistics
+// Stats serves as a receiver of server statistics. Listen updates them
+// under mu, and they're only read through snapshot.
 type Stats struct {
-	Started        time.Time         `json:"started"`
-	BadRequests    uint64            `json:"bad_requests"`
-	Timeouts       uint64            `json:"timeouts"`
-	TotalServed    uint64            `json:"total_served"`
-	TotalByVersion map[string]uint64 `json:"total_by_version"`
+	mu             sync.Mutex
+	Started        time.Time
+	BadRequests    uint64
+	Timeouts       uint64
+	TotalServed    uint64
+	TotalByVersion map[string]uint64
+	Watermarks     map[string]uint64
+	served         rollingCounter
+	badRequests    rollingCounter
+	timeouts       rollingCounter
+	latencies      map[string]*latencyRing
 	statsChan      chan *stat
 	logger         ILogger
+	db             *DB
+}
+
+// statsSnapshot is a consistent copy of the stats, for serializing
+type statsSnapshot struct {
+	Started        time.Time              `json:"started"`
+	BadRequests    uint64                 `json:"bad_requests"`
+	Timeouts       uint64                 `json:"timeouts"`
+	TotalServed    uint64                 `json:"total_served"`
+	TotalByVersion map[string]uint64      `json:"total_by_version"`
+	Watermarks     map[string]uint64      `json:"watermark_decisions"`
+	DroppedStats   uint64                 `json:"dropped_stats"`
+	Rates          map[string]Rates       `json:"rates"`
+	Latency        map[string]Percentiles `json:"latency_ms"`
 }
 
 // NewStats instantiates and returns a new stats handler
@@ -79,7 +183,9 @@ func NewStats(logger ILogger) *Stats {
 		logger:      logger,
 	}
 	s.TotalByVersion = make(map[string]uint64)
-	s.statsChan = make(chan *stat, 10)
+	s.Watermarks = make(map[string]uint64)
+	s.latencies = make(map[string]*latencyRing)
+	s.statsChan = make(chan *stat, statsBuffer)
 
 	return &s
 }
@@ -90,17 +196,78 @@ func (s *Stats) Listen() {
 		st := <-s.statsChan
 		s.logger.Debug("Incoming stat: %v", st)
 
+		now := time.Now()
+		s.mu.Lock()
 		switch st.T {
 		case StatBadRequest:
 			s.BadRequests++
+			s.badRequests.add(now)
 		case StatTimeout:
 			s.Timeouts++
+			s.timeouts.add(now)
 		case StatServedPicture:
 			s.TotalServed++
 			s.TotalByVersion[st.Payload]++
+			s.served.add(now)
+			s.recordLatency(now, st.Payload, st.Latency)
+		case StatWatermarkDecision:
+			s.Watermarks[st.Payload]++
 		default:
 			s.logger.Warn("Unknown stat: %v", st)
 		}
+		s.mu.Unlock()
+	}
+}
+
+// Record passes st on to Listen
+func (s *Stats) Record(st *stat) {
+	sendStat(s.statsChan, st)
+}
+
+func copyCounts(counts map[string]uint64) map[string]uint64 {
+	c := make(map[string]uint64, len(counts))
+	for k, v := range counts {
+		c[k] = v
+	}
+
+	return c
+}
+
+// recordLatency keeps the latency of a request for version. The caller holds
+// s.mu.
+func (s *Stats) recordLatency(now time.Time, version string, latency time.Duration) {
+	ring, ok := s.latencies[version]
+	if !ok {
+		ring = &latencyRing{}
+		s.latencies[version] = ring
+	}
+	ring.add(now, latency)
+}
+
+func (s *Stats) snapshot() statsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	latency := make(map[string]Percentiles, len(s.latencies))
+	for version, ring := range s.latencies {
+		latency[version] = ring.percentiles(now)
+	}
+
+	return statsSnapshot{
+		Started:        s.Started,
+		BadRequests:    s.BadRequests,
+		Timeouts:       s.Timeouts,
+		TotalServed:    s.TotalServed,
+		TotalByVersion: copyCounts(s.TotalByVersion),
+		Watermarks:     copyCounts(s.Watermarks),
+		DroppedStats:   atomic.LoadUint64(&droppedStats),
+		Rates: map[string]Rates{
+			"served":       s.served.rates(now, s.Started),
+			"bad_requests": s.badRequests.rates(now, s.Started),
+			"timeouts":     s.timeouts.rates(now, s.Started),
+		},
+		Latency: latency,
 	}
 }
 
@@ -110,27 +277,52 @@ func (s *Stats) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	s.logger.Debug("Request for /stats")
 
-	body, err := json.Marshal(s)
+	var pool *PoolStats
+	var replicas []ReplicaStats
+	var fallbacks uint64
+	if s.db != nil {
+		st := s.db.poolStats()
+		pool = &st
+		replicas = s.db.replicaStats()
+		fallbacks = atomic.LoadUint64(&s.db.primaryFallbacks)
+	}
+
+	body, err := json.Marshal(struct {
+		statsSnapshot
+		Database         *PoolStats     `json:"database,omitempty"`
+		Replicas         []ReplicaStats `json:"replicas,omitempty"`
+		PrimaryFallbacks uint64         `json:"primary_fallbacks,omitempty"`
+	}{s.snapshot(), pool, replicas, fallbacks})
 
 	if err != nil {
 		http.Error(w, fmt.Sprintf("ERROR: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	fmt.Fprintf(w, string(body[:]))
+	_, _ = w.Write(body)
 }
 
-// Start starts the stats server on the specified port and starts listening for stats
-func (s *Stats) Start(config *Config) {
+// Start starts the stats server on the specified port and starts listening for
+// stats, reporting on db's connection pool, serving metrics for Prometheus and
+// liveness and readiness checks. Picture prefetching is served here too,
+// since it queries the database on demand.
+func (s *Stats) Start(config *Config, db *DB, metrics *Metrics, ready *readiness) {
+	s.db = db
+	s.mu.Lock()
 	for _, name := range config.VersionNames() {
 		s.TotalByVersion[name] = 0
 	}
 	s.Started = time.Now()
+	s.mu.Unlock()
 	go s.Listen()
 
 	mux := http.NewServeMux()
 	mux.Handle("/config", configHandler{config, s.logger})
 	mux.Handle("/stats", s)
+	mux.Handle("/metrics", metricsHandler{metrics, db, s.logger})
+	mux.Handle(prefetchPath, prefetchHandler{config, ready.source, s.logger})
+	mux.Handle(healthPath, healthHandler{ready.source, s.logger})
+	mux.Handle(readyPath, readyHandler{ready, s.logger})
 
 	server := &http.Server{
 		Addr:         config.StatsServer.BindAddr(),
@@ -16,8 +16,11 @@
 package main
 
 import (
+	"database/sql"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -37,7 +40,7 @@ func TestStatsServer(t *testing.T) {
 		body := w.Body.String()
 		So(body, ShouldContainSubstring, `"total_served":0`)
 
-		stats.statsChan <- &stat{StatServedPicture, "thumb"}
+		stats.statsChan <- &stat{T: StatServedPicture, Payload: "thumb", Latency: time.Millisecond}
 		time.Sleep(5 * time.Millisecond) // Give the goroutine time to process the chan
 
 		newW := httptest.NewRecorder()
@@ -48,9 +51,91 @@ func TestStatsServer(t *testing.T) {
 		newBody := newW.Body.String()
 		So(newBody, ShouldContainSubstring, `"total_served":1`)
 		So(newBody, ShouldContainSubstring, `"thumb":1`)
+		So(newBody, ShouldContainSubstring, `"latency_ms":{"thumb":{"p50":1,"p90":1,"p99":1,"samples":1}}`)
+		So(newBody, ShouldContainSubstring, `"rates":{"bad_requests":{"15m":0,"1m":0,"5m":0}`)
+
+		stats.statsChan <- &stat{T: StatWatermarkDecision, Payload: decisionGuestOwnerMark}
+		time.Sleep(5 * time.Millisecond)
+
+		markW := httptest.NewRecorder()
+		stats.ServeHTTP(markW, newReq)
+		So(markW.Body.String(), ShouldContainSubstring, `"watermark_decisions":{"guest_owner_mark":1}`)
+
+		stats.statsChan <- &stat{T: StatWatermarkDecision, Payload: "100%s"}
+		time.Sleep(5 * time.Millisecond)
+
+		markW = httptest.NewRecorder()
+		stats.ServeHTTP(markW, newReq)
+		So(markW.Body.String(), ShouldContainSubstring, `"100%s":1`)
 	}))
 }
 
+func TestStatsConcurrency(t *testing.T) {
+	Convey("Stats are collected and served concurrently", t, func() {
+		stats := NewStats(testLogger{})
+		go stats.Listen()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					sendStat(stats.statsChan, &stat{T: StatServedPicture, Payload: "thumb", Latency: time.Millisecond})
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					stats.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/stats", nil))
+				}
+			}()
+		}
+		wg.Wait()
+
+		// All 800 fit in the buffer, so none are dropped
+		for i := 0; i < 100 && stats.snapshot().TotalServed < 800; i++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+		So(stats.snapshot().TotalServed, ShouldEqual, 800)
+		So(stats.snapshot().TotalByVersion["thumb"], ShouldEqual, 800)
+	})
+
+	Convey("Stats are dropped rather than blocking", t, func() {
+		ch := make(chan *stat, 1)
+		before := atomic.LoadUint64(&droppedStats)
+
+		sendStat(ch, &stat{T: StatBadRequest})
+		sendStat(ch, &stat{T: StatBadRequest})
+		So(atomic.LoadUint64(&droppedStats)-before, ShouldEqual, 1)
+
+		stats := NewStats(testLogger{})
+		w := httptest.NewRecorder()
+		stats.ServeHTTP(w, httptest.NewRequest("GET", "/stats", nil))
+		So(w.Body.String(), ShouldContainSubstring, `"dropped_stats":`)
+	})
+}
+
+func TestStatsPoolStats(t *testing.T) {
+	Convey("StatsServer reports the database pool", t, func() {
+		conn, err := sql.Open("ibex-hanging", "")
+		So(err, ShouldBeNil)
+		conn.SetMaxOpenConns(7)
+
+		stats := NewStats(testLogger{})
+		stats.db = &DB{conn: conn}
+
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/stats", nil)
+		So(err, ShouldBeNil)
+		stats.ServeHTTP(w, req)
+
+		body := w.Body.String()
+		So(body, ShouldContainSubstring, `"total_served":0`)
+		So(body, ShouldContainSubstring, `"database":{"max_open":7,"open":0,"in_use":0,"idle":0,"wait_count":0`)
+	})
+}
+
 func TestConfigServer(t *testing.T) {
 	Convey("ConfigServer", t, withTestFixtures(func(config *Config, db *DB, logger testLogger) {
 		handler := configHandler{config, logger}
@@ -61,6 +146,30 @@ func TestConfigServer(t *testing.T) {
 		handler.ServeHTTP(w, req)
 
 		body := w.Body.String()
-		So(body, ShouldContainSubstring, `"bind_port":192048`)
+		So(body, ShouldContainSubstring, `"bind_port":19248`)
+		So(body, ShouldNotContainSubstring, "gotest:gotest")
+
+		Convey("Full dumps need the admin token", func() {
+			fullReq, err := http.NewRequest("GET", "/config?full=1", nil)
+			So(err, ShouldBeNil)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, fullReq)
+			So(w.Code, ShouldEqual, http.StatusForbidden)
+
+			config.StatsServer.AdminToken = "s3cret"
+			fullReq.Header.Set("Authorization", "Bearer wrong")
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, fullReq)
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+
+			config.OverlaySecret = "100%s"
+			fullReq.Header.Set("Authorization", "Bearer s3cret")
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, fullReq)
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Body.String(), ShouldContainSubstring, "gotest:gotest")
+			So(w.Body.String(), ShouldContainSubstring, `"overlay_secret":"100%s"`)
+		})
 	}))
 }
@@ -0,0 +1,302 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	statsdFormatDogStatsD = "dogstatsd"
+	statsdFormatPlain     = "statsd"
+
+	defaultStatsdAddress = "127.0.0.1:8125"
+	defaultStatsdPrefix  = "ibex."
+	defaultFlushSeconds  = 10
+
+	// maxStatsdPacket keeps packets within a typical MTU
+	maxStatsdPacket = 1432
+
+	// maxTimingSamples caps the timings kept per metric between flushes.
+	// Past it they're sampled, and sent with their sample rate.
+	maxTimingSamples = 100
+)
+
+var statsdUnsafe = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// StatsDConfig contains configuration for sending stats to StatsD. Stats are
+// aggregated and sent every flush_seconds, tagged DogStatsD style or, with
+// the statsd format, with the tags folded into the metric names.
+type StatsDConfig struct {
+	Enabled      bool   `json:"enabled"`
+	Address      string `json:"address"`
+	Prefix       string `json:"prefix"`
+	Format       string `json:"format"`
+	FlushSeconds int    `json:"flush_seconds"`
+}
+
+func (c StatsDConfig) address() string {
+	if len(c.Address) == 0 {
+		return defaultStatsdAddress
+	}
+
+	return c.Address
+}
+
+func (c StatsDConfig) prefix() string {
+	if len(c.Prefix) == 0 {
+		return defaultStatsdPrefix
+	}
+
+	return c.Prefix
+}
+
+func (c StatsDConfig) format() string {
+	if len(c.Format) == 0 {
+		return statsdFormatDogStatsD
+	}
+
+	return c.Format
+}
+
+func (c StatsDConfig) flushInterval() time.Duration {
+	if c.FlushSeconds == 0 {
+		return defaultFlushSeconds * time.Second
+	}
+
+	return time.Duration(c.FlushSeconds) * time.Second
+}
+
+func (c StatsDConfig) validate(errs *ConfigErrors, path string) {
+	if !c.Enabled {
+		return
+	}
+
+	if _, _, err := net.SplitHostPort(c.address()); err != nil {
+		errs.add(path+".address", "must be a host:port, got %q", c.Address)
+	}
+	switch c.format() {
+	case statsdFormatDogStatsD, statsdFormatPlain:
+	default:
+		errs.add(path+".format", "must be %s or %s, got %q", statsdFormatDogStatsD, statsdFormatPlain, c.Format)
+	}
+	if c.FlushSeconds < 0 {
+		errs.add(path+".flush_seconds", "must not be negative, got %d", c.FlushSeconds)
+	}
+}
+
+// statsdTag is a tag of a StatsD metric
+type statsdTag struct {
+	key, value string
+}
+
+// statsdKey identifies an aggregated metric by its name and tags
+type statsdKey struct {
+	name string
+	tags string
+}
+
+type statsdTimings struct {
+	samples []float64
+	count   int
+}
+
+// statsdSink is a StatsSink sending to StatsD over UDP. Counters are summed
+// and timings collected between flushes, so a busy server sends a few
+// packets per flush rather than one per request.
+type statsdSink struct {
+	prefix string
+	format string
+	conn   net.Conn
+	logger ILogger
+
+	mu          sync.Mutex
+	counters    map[statsdKey]int64
+	timings     map[statsdKey]*statsdTimings
+	lastDropped uint64
+}
+
+func newStatsdSink(c StatsDConfig, logger ILogger) (*statsdSink, error) {
+	conn, err := net.Dial("udp", c.address())
+	if err != nil {
+		return nil, err
+	}
+
+	return &statsdSink{
+		prefix:      c.prefix(),
+		format:      c.format(),
+		conn:        conn,
+		logger:      logger,
+		counters:    make(map[statsdKey]int64),
+		timings:     make(map[statsdKey]*statsdTimings),
+		lastDropped: atomic.LoadUint64(&droppedStats),
+	}, nil
+}
+
+func statsdStatus(st *stat) string {
+	if st.Status == 0 {
+		return unknownLabel
+	}
+
+	return strconv.Itoa(st.Status)
+}
+
+// Record aggregates st until the next flush
+func (s *statsdSink) Record(st *stat) {
+	requestTags := []statsdTag{{"version", st.Payload}, {"env", envLabel(st.Env)}, {"status", statsdStatus(st)}}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch st.T {
+	case StatServedPicture:
+		s.count("requests", requestTags)
+		s.time("latency", requestTags[:2], st.Latency)
+	case StatBadRequest:
+		s.count("requests", requestTags)
+		s.count("bad_requests", requestTags)
+	case StatTimeout:
+		s.count("requests", requestTags)
+		s.count("timeouts", requestTags)
+	case StatWatermarkDecision:
+		s.count("watermark_decisions", []statsdTag{{"decision", st.Payload}})
+	}
+}
+
+// key names a metric with its tags, in the sink's format. The caller holds
+// s.mu.
+func (s *statsdSink) key(name string, tags []statsdTag) statsdKey {
+	if s.format == statsdFormatPlain {
+		parts := []string{s.prefix + name}
+		for _, tag := range tags {
+			parts = append(parts, statsdUnsafe.ReplaceAllString(tag.value, "_"))
+		}
+		return statsdKey{name: strings.Join(parts, ".")}
+	}
+
+	pairs := make([]string, len(tags))
+	for i, tag := range tags {
+		pairs[i] = tag.key + ":" + statsdUnsafe.ReplaceAllString(tag.value, "_")
+	}
+
+	return statsdKey{name: s.prefix + name, tags: strings.Join(pairs, ",")}
+}
+
+func (s *statsdSink) count(name string, tags []statsdTag) {
+	s.counters[s.key(name, tags)]++
+}
+
+func (s *statsdSink) time(name string, tags []statsdTag, d time.Duration) {
+	key := s.key(name, tags)
+	t, ok := s.timings[key]
+	if !ok {
+		t = &statsdTimings{}
+		s.timings[key] = t
+	}
+
+	ms := float64(d) / float64(time.Millisecond)
+	t.count++
+	if len(t.samples) < maxTimingSamples {
+		t.samples = append(t.samples, ms)
+	} else if i := rand.Intn(t.count); i < maxTimingSamples {
+		// Once the samples are full every timing has an equal chance to stay
+		t.samples[i] = ms
+	}
+}
+
+func (k statsdKey) line(value, kind string, rate float64) string {
+	line := k.name + ":" + value + "|" + kind
+	if rate < 1 {
+		line += "|@" + strconv.FormatFloat(rate, 'f', 4, 64)
+	}
+	if len(k.tags) > 0 {
+		line += "|#" + k.tags
+	}
+
+	return line
+}
+
+// lines takes the aggregated metrics as StatsD lines, sorted, and resets them
+func (s *statsdSink) lines() []string {
+	s.mu.Lock()
+	counters, timings := s.counters, s.timings
+	s.counters = make(map[statsdKey]int64)
+	s.timings = make(map[statsdKey]*statsdTimings)
+	dropped := atomic.LoadUint64(&droppedStats)
+	newlyDropped := dropped - s.lastDropped
+	s.lastDropped = dropped
+	s.mu.Unlock()
+
+	var lines []string
+	for key, n := range counters {
+		lines = append(lines, key.line(strconv.FormatInt(n, 10), "c", 1))
+	}
+	for key, t := range timings {
+		rate := float64(len(t.samples)) / float64(t.count)
+		for _, ms := range t.samples {
+			lines = append(lines, key.line(strconv.FormatFloat(ms, 'f', -1, 64), "ms", rate))
+		}
+	}
+
+	if newlyDropped > 0 {
+		lines = append(lines, statsdKey{name: s.prefix + "dropped_stats"}.line(strconv.FormatUint(newlyDropped, 10), "c", 1))
+	}
+
+	sort.Strings(lines)
+	return lines
+}
+
+// flush sends the aggregated metrics, in as few packets as fit
+func (s *statsdSink) flush() {
+	var packet bytes.Buffer
+	send := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, err := s.conn.Write(packet.Bytes()); err != nil {
+			s.logger.Warn("Couldn't send stats to StatsD: %v", err)
+		}
+		packet.Reset()
+	}
+
+	for _, line := range s.lines() {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxStatsdPacket {
+			send()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	send()
+}
+
+// flushEvery flushes the metrics every interval, forever
+func (s *statsdSink) flushEvery(interval time.Duration) {
+	s.logger.Info("Sending stats to StatsD at %s every %s", s.conn.RemoteAddr(), interval)
+	for range time.Tick(interval) {
+		s.flush()
+	}
+}
@@ -0,0 +1,166 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStatsdSink(t *testing.T) {
+	Convey("The StatsD sink", t, func() {
+		listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer listener.Close()
+
+		config := StatsDConfig{Enabled: true, Address: listener.LocalAddr().String()}
+
+		receive := func() string {
+			buf := make([]byte, 65536)
+			So(listener.SetReadDeadline(time.Now().Add(time.Second)), ShouldBeNil)
+			n, _, err := listener.ReadFrom(buf)
+			So(err, ShouldBeNil)
+			return string(buf[:n])
+		}
+
+		Convey("Aggregates tagged stats between flushes", func() {
+			sink, err := newStatsdSink(config, testLogger{})
+			So(err, ShouldBeNil)
+
+			for i := 0; i < 3; i++ {
+				sink.Record(&stat{T: StatServedPicture, Payload: "thumb", Env: "production", Status: 200, Latency: 20 * time.Millisecond})
+			}
+			sink.Record(&stat{T: StatBadRequest, Payload: "thumb", Env: "production", Status: 404})
+			sink.Record(&stat{T: StatBadRequest, Payload: "thumb", Env: "random123", Status: 404})
+			sink.Record(&stat{T: StatWatermarkDecision, Payload: decisionGuestOwnerMark})
+			sink.flush()
+
+			lines := strings.Split(receive(), "\n")
+			So(lines, ShouldContain, "ibex.requests:3|c|#version:thumb,env:production,status:200")
+			So(lines, ShouldContain, "ibex.requests:1|c|#version:thumb,env:production,status:404")
+			So(lines, ShouldContain, "ibex.bad_requests:1|c|#version:thumb,env:production,status:404")
+			So(lines, ShouldContain, "ibex.bad_requests:1|c|#version:thumb,env:unknown,status:404")
+			So(lines, ShouldContain, "ibex.watermark_decisions:1|c|#decision:guest_owner_mark")
+			So(lines, ShouldContain, "ibex.latency:20|ms|#version:thumb,env:production")
+			So(lines, ShouldHaveLength, 9)
+
+			Convey("and starts over after flushing", func() {
+				So(sink.lines(), ShouldBeEmpty)
+			})
+		})
+
+		Convey("Folds tags into names in the statsd format", func() {
+			config.Format = statsdFormatPlain
+			config.Prefix = "app.ibex."
+			sink, err := newStatsdSink(config, testLogger{})
+			So(err, ShouldBeNil)
+
+			sink.Record(&stat{T: StatTimeout, Payload: "thumb", Env: "staging", Status: 504})
+			So(sink.lines(), ShouldResemble, []string{
+				"app.ibex.requests.thumb.staging.504:1|c",
+				"app.ibex.timeouts.thumb.staging.504:1|c",
+			})
+		})
+
+		Convey("Samples timings past the cap", func() {
+			sink, err := newStatsdSink(config, testLogger{})
+			So(err, ShouldBeNil)
+
+			for i := 0; i < 4*maxTimingSamples; i++ {
+				sink.Record(&stat{T: StatServedPicture, Payload: "thumb", Env: "production", Status: 200, Latency: time.Millisecond})
+			}
+
+			var timings []string
+			for _, line := range sink.lines() {
+				if strings.Contains(line, "|ms") {
+					timings = append(timings, line)
+				}
+			}
+			So(timings, ShouldHaveLength, maxTimingSamples)
+			So(timings[0], ShouldEqual, "ibex.latency:1|ms|@0.2500|#version:thumb,env:production")
+		})
+
+		Convey("Splits packets to fit the MTU", func() {
+			sink, err := newStatsdSink(config, testLogger{})
+			So(err, ShouldBeNil)
+
+			for i := 0; i < 100; i++ {
+				sink.Record(&stat{T: StatServedPicture, Payload: strings.Repeat("v", 20) + string(rune('a'+i%26)) + string(rune('a'+i/26)), Status: 200})
+			}
+			sink.flush()
+
+			So(len(receive()), ShouldBeLessThanOrEqualTo, maxStatsdPacket)
+			So(len(receive()), ShouldBeLessThanOrEqualTo, maxStatsdPacket)
+		})
+
+		Convey("Reports stats dropped since the last flush", func() {
+			sink, err := newStatsdSink(config, testLogger{})
+			So(err, ShouldBeNil)
+
+			full := make(chan *stat)
+			sendStat(full, &stat{T: StatBadRequest})
+			So(sink.lines(), ShouldResemble, []string{"ibex.dropped_stats:1|c"})
+			So(sink.lines(), ShouldBeEmpty)
+		})
+
+		Convey("Validates its config", func() {
+			errs := ConfigErrors{}
+			StatsDConfig{Enabled: true, Address: "nowhere", Format: "graphite"}.validate(&errs, "$.statsd")
+			So(errs, ShouldHaveLength, 2)
+		})
+	})
+}
+
+// recordingSink keeps the stats it's given
+type recordingSink struct {
+	mu    sync.Mutex
+	stats []*stat
+}
+
+func (r *recordingSink) Record(st *stat) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stats = append(r.stats, st)
+}
+
+func (r *recordingSink) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.stats)
+}
+
+func TestStatsChan(t *testing.T) {
+	Convey("Stats are passed on to every sink", t, func() {
+		one, two := &recordingSink{}, &recordingSink{}
+		ch := newStatsChan(one, two)
+
+		sendStat(ch, &stat{T: StatBadRequest})
+		sendStat(ch, &stat{T: StatTimeout})
+
+		for i := 0; i < 100 && two.count() < 2; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		So(one.count(), ShouldEqual, 2)
+		So(two.count(), ShouldEqual, 2)
+	})
+}
@@ -3,12 +3,14 @@ create table if not exists pictures(
   user_id integer,
   event_id integer,
   attachment varchar(255),
-  watermark_id integer
+  watermark_id integer,
+  deleted_at timestamp
 );
 
 create table if not exists events(
        id integer primary key,
-       owner_id integer
+       owner_id integer,
+       deleted_at timestamp
 );
 
 create table if not exists photographer_infos(
@@ -26,14 +28,27 @@ create table if not exists watermarks(
        alpha integer,
        "scale" integer,
        "offset" integer,
-       "position" varchar(255)
+       "position" varchar(255),
+       text varchar(255),
+       text_font varchar(255),
+       text_size integer,
+       text_color varchar(255),
+       text_alpha integer,
+       text_position varchar(255),
+       deleted_at timestamp,
+       updated_at timestamp
 );
 
 insert into pictures values(1, 1, 1, 'test_pic.jpg');
 insert into pictures values(2, 2, 1, 'guest_test_pic.jpg');
+insert into pictures values(3, 1, 1, 'text_mark_test_pic.jpg', 6);
+insert into pictures values(4, 1, 1, 'deleted_test_pic.jpg', null, now());
+insert into pictures values(5, 3, 3, 'deleted_event_test_pic.jpg');
+insert into pictures values(6, 1, 1, 'deleted_mark_test_pic.jpg', 7);
 
 insert into events values(1, 1);
 insert into events values(2, 3);
+insert into events values(3, 3, now());
 
 insert into photographer_infos values(1, 1, 'test_watermark.jpg');
 insert into photographer_infos values(2, 3, 'extra_test_watermark.jpg');
@@ -45,3 +60,24 @@ insert into watermarks values(2, 1, FALSE, FALSE, 'test_watermark_error.jpg', 10
 insert into watermarks values(3, 2, FALSE, TRUE, 'test_watermark2.jpg', 100, 100, 1, E'---\n- top\n- left\n');
 insert into watermarks values(4, 3, FALSE, TRUE, 'test_watermark3.jpg', 20, 75, 0, E'---\n- top\n- right\n');
 insert into watermarks values(5, 4, TRUE, TRUE, null, null, null, null, null);
+insert into watermarks values(6, 1, FALSE, FALSE, null, null, null, null, null, 'Photo by Test Photographer', null, 32, '000000', 50, E'---\n- bottom\n- right\n');
+insert into watermarks values(7, 1, FALSE, FALSE, 'deleted_watermark.jpg', 100, 100, 0, E'---\n- top\n', null, null, null, null, null, null, now());
+insert into watermarks values(8, 1, FALSE, TRUE, 'older_test_watermark.jpg', 100, 100, 0, E'---\n- top\n', null, null, null, null, null, null, null, '2016-01-01');
+update watermarks set updated_at = '2016-06-01' where updated_at is null;
+
+create or replace function ibex_notify() returns trigger as $$
+begin
+  perform pg_notify('ibex_invalidate', TG_TABLE_NAME || ':' ||
+    case TG_OP when 'DELETE' then OLD.id else NEW.id end);
+  return null;
+end;
+$$ language plpgsql;
+
+create trigger ibex_notify after insert or update or delete on pictures
+  for each row execute procedure ibex_notify();
+create trigger ibex_notify after insert or update or delete on watermarks
+  for each row execute procedure ibex_notify();
+create trigger ibex_notify after insert or update or delete on events
+  for each row execute procedure ibex_notify();
+create trigger ibex_notify after insert or update or delete on photographer_infos
+  for each row execute procedure ibex_notify();
@@ -0,0 +1,268 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	minPort = 1
+	maxPort = 65535
+)
+
+var dsnKeyMatcher = regexp.MustCompile(`^[a-zA-Z_]+\s*=\s*`)
+
+// ConfigError is a single validation failure, located by its JSON path
+type ConfigError struct {
+	Path    string
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// ConfigErrors collects every validation failure in a config
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+
+	return fmt.Sprintf("Invalid config:\n  %s", strings.Join(lines, "\n  "))
+}
+
+func (e *ConfigErrors) add(path, format string, args ...interface{}) {
+	*e = append(*e, ConfigError{path, fmt.Sprintf(format, args...)})
+}
+
+func (e *ConfigErrors) check(path string, err error) {
+	if err != nil {
+		e.add(path, "%v", err)
+	}
+}
+
+func validatePort(errs *ConfigErrors, path string, port int) {
+	if port < minPort || port > maxPort {
+		errs.add(path, "must be between %d and %d, got %d", minPort, maxPort, port)
+	}
+}
+
+func validateURL(errs *ConfigErrors, path, raw string, schemes ...string) {
+	if len(raw) == 0 {
+		errs.add(path, "is required")
+		return
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		errs.add(path, "is not a valid URL: %s", redactCredentials(err.Error()))
+		return
+	}
+
+	for _, scheme := range schemes {
+		if u.Scheme == scheme && len(u.Host) > 0 {
+			return
+		}
+	}
+
+	errs.add(path, "must be a %s URL with a host", strings.Join(schemes, " or "))
+}
+
+// validateDSN checks a Postgres connection string, either a postgres URL or
+// libpq's key=value form
+func validateDSN(errs *ConfigErrors, path, raw string) {
+	if len(raw) == 0 || strings.Contains(raw, "://") {
+		validateURL(errs, path, raw, "postgres", "postgresql")
+		return
+	}
+
+	errs.check(path, checkKeyValueDSN(raw))
+}
+
+// checkKeyValueDSN checks the syntax of a key=value connection string like
+// "host=db.test dbname=snapshots password='a b'". Values are left out of the
+// errors, since they may be passwords.
+func checkKeyValueDSN(dsn string) error {
+	rest := strings.TrimSpace(dsn)
+	for len(rest) > 0 {
+		key := dsnKeyMatcher.FindString(rest)
+		if len(key) == 0 {
+			return errors.New("must be a postgres URL or a key=value connection string")
+		}
+		rest = rest[len(key):]
+
+		end, err := dsnValueEnd(rest)
+		if err != nil {
+			return fmt.Errorf("has %v in the value for %s", err, strings.TrimRight(key, "= \t\r\n"))
+		}
+		rest = strings.TrimSpace(rest[end:])
+	}
+
+	return nil
+}
+
+// dsnValueEnd finds where the value at the start of rest ends: after its
+// closing quote if it's quoted, or at the first space. A backslash escapes
+// the character after it.
+func dsnValueEnd(rest string) (int, error) {
+	quoted := strings.HasPrefix(rest, "'")
+	i := 0
+	if quoted {
+		i = 1
+	}
+
+	for ; i < len(rest); i++ {
+		switch c := rest[i]; {
+		case c == '\\':
+			i++
+			if i == len(rest) {
+				return 0, errors.New("a trailing backslash")
+			}
+		case quoted && c == '\'':
+			if i+1 < len(rest) && !unicode.IsSpace(rune(rest[i+1])) {
+				return 0, errors.New("no space after the closing quote")
+			}
+			return i + 1, nil
+		case !quoted && unicode.IsSpace(rune(c)):
+			return i, nil
+		}
+	}
+
+	if quoted {
+		return 0, errors.New("an unterminated quote")
+	}
+	return i, nil
+}
+
+func validateParam(errs *ConfigErrors, path, key string, val interface{}) {
+	_, err := parseVersionParam(key, val)
+	errs.check(path, err)
+}
+
+// Validate checks the whole config and returns every problem found, or nil
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+
+	validatePort(&errs, "$.bind_port", c.BindPort)
+	if c.StatsServer.Enabled {
+		validatePort(&errs, "$.stats_server.bind_port", c.StatsServer.BindPort)
+		if c.StatsServer.BindPort == c.BindPort {
+			errs.add("$.stats_server.bind_port", "must differ from bind_port")
+		}
+	}
+
+	c.Source.validate(&errs, "$.source")
+	if c.Source.kind() == sourcePostgres {
+		validateDSN(&errs, "$.database_url", c.DatabaseURL)
+	}
+	validateURL(&errs, "$.imagizer_host", c.ImagizerHost, "http", "https")
+	validateURL(&errs, "$.cdn_host", c.CDNHost, "http", "https")
+	if len(c.OverlayHost) > 0 {
+		validateURL(&errs, "$.overlay_host", c.OverlayHost, "http", "https")
+	}
+
+	c.Database.validate(&errs, "$.database")
+	c.PictureCache.validate(&errs, "$.picture_cache")
+	if len(c.Database.Replicas) > 0 && !c.PictureCache.Enabled {
+		errs.add("$.database.replicas", "need the picture cache enabled, to read changed pictures from the primary")
+	}
+	c.DegradedMode.validate(&errs, "$.degraded_mode")
+	c.SoftDelete.validate(&errs, "$.soft_delete")
+	c.SchemaCheck.validate(&errs, "$.schema_check")
+	c.Readiness.validate(&errs, "$.readiness")
+	c.StatsD.validate(&errs, "$.statsd")
+
+	if len(c.Versions) == 0 {
+		errs.add("$.versions", "at least one version is required")
+	}
+
+	indexes := make(map[string]int)
+	for i, v := range c.Versions {
+		path := fmt.Sprintf("$.versions[%d]", i)
+		name := versionName(v.Name)
+
+		if len(name) == 0 {
+			errs.add(path+".name", "is required")
+		} else if first, ok := indexes[name]; ok {
+			errs.add(path+".name", "duplicates the name of $.versions[%d]", first)
+		} else {
+			indexes[name] = i
+		}
+
+		errs.check(path+".function_name", validateFunctionName(v.FunctionName))
+		v.OutputOptions.validate(&errs, path)
+		errs.check(path+".watermark_mode", validateWatermarkMode(v.WatermarkMode))
+		errs.check(path+".watermark_policy", validateWatermarkPolicy(v.WatermarkPolicy))
+		if v.WatermarkMode == watermarkModeTiled && (len(c.OverlayHost) == 0 || len(c.OverlaySecret) == 0) {
+			errs.add(path+".watermark_mode", "tiled watermarks need an overlay_host and overlay_secret")
+		}
+
+		for j, l := range v.WatermarkLayers {
+			errs.check(fmt.Sprintf("%s.watermark_layers[%d].type", path, j), l.validate())
+		}
+
+		for j, key := range v.RepeatedParams {
+			if len(key) == 0 {
+				errs.add(fmt.Sprintf("%s.repeated_params[%d]", path, j), "is empty")
+			}
+		}
+
+		keys := make([]string, 0, len(v.Params))
+		for key := range v.Params {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			validateParam(&errs, fmt.Sprintf("%s.params.%s", path, key), key, v.Params[key])
+		}
+	}
+
+	declared := c.declaredVersions()
+	for i, v := range c.Versions {
+		resolved, err := resolveVersion(v, declared, nil)
+		if err != nil {
+			errs.check(fmt.Sprintf("$.versions[%d].extends", i), err)
+			continue
+		}
+
+		// Bad params are reported above, where they're set
+		props, err := resolved.properties()
+		if err != nil {
+			continue
+		}
+
+		_, err = gravityCrop(props)
+		errs.check(fmt.Sprintf("$.versions[%d].params.gravity", i), err)
+		errs.check(fmt.Sprintf("$.versions[%d].background_color", i), validatePadBackground(props))
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
@@ -0,0 +1,280 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+const (
+	layerTypeLogo = "logo"
+	layerTypeText = "text"
+
+	logoParamPrefix = "mark"
+	textParamPrefix = "text"
+
+	defaultTextSize     = 24
+	defaultTextColor    = "ffffff"
+	defaultTextAlpha    = 70
+	defaultTextOffset   = 3
+	defaultTextPosition = "bottom,left"
+
+	watermarkModeCorner   = "corner"
+	watermarkModeTiled    = "tiled"
+	watermarkModeCentered = "centered"
+
+	centeredMinScale = 50
+
+	policyOwnerOnly        = "owner_only"
+	policyEveryone         = "everyone"
+	policyGuestDefaultMark = "guests_with_default_mark"
+	policyGuestOwnerMark   = "guests_with_owner_mark"
+
+	decisionOwner            = "owner"
+	decisionGuestUnmarked    = "guest_unmarked"
+	decisionGuestOwnMark     = "guest_own_mark"
+	decisionGuestDefaultMark = "guest_default_mark"
+	decisionGuestOwnerMark   = "guest_owner_mark"
+)
+
+// WatermarkLayer contains a single watermark layer from a version's config.
+// Zero-valued fields fall back to the photographer's watermark from the DB.
+type WatermarkLayer struct {
+	Type     string `json:"type"`
+	Logo     string `json:"logo,omitempty"`
+	Text     string `json:"text,omitempty"`
+	Font     string `json:"font,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Color    string `json:"color,omitempty"`
+	Alpha    int64  `json:"alpha,omitempty"`
+	Scale    int64  `json:"scale,omitempty"`
+	Offset   int64  `json:"offset,omitempty"`
+	Position string `json:"position,omitempty"`
+}
+
+func (l WatermarkLayer) validate() error {
+	switch l.Type {
+	case layerTypeLogo, layerTypeText:
+		return nil
+	default:
+		return fmt.Errorf("Unknown watermark layer type %q", l.Type)
+	}
+}
+
+func validateWatermarkMode(mode string) error {
+	switch mode {
+	case "", watermarkModeCorner, watermarkModeTiled, watermarkModeCentered:
+		return nil
+	default:
+		return fmt.Errorf("Unknown watermark mode %q", mode)
+	}
+}
+
+func validateWatermarkPolicy(policy string) error {
+	switch policy {
+	case "", policyOwnerOnly, policyEveryone, policyGuestDefaultMark, policyGuestOwnerMark:
+		return nil
+	default:
+		return fmt.Errorf("Unknown watermark policy %q", policy)
+	}
+}
+
+// markLayer is a fully resolved watermark layer, ready to be turned into
+// Imagizer params
+type markLayer struct {
+	kind     string
+	source   string
+	font     string
+	color    string
+	position string
+	size     int64
+	alpha    int64
+	scale    int64
+	offset   int64
+}
+
+func logoLayerFromWatermark(wm watermark) markLayer {
+	return markLayer{
+		kind:     layerTypeLogo,
+		source:   wm.logo.String,
+		position: wm.position.String,
+		alpha:    nullInt64Or(wm.alpha, 0),
+		scale:    nullInt64Or(wm.scale, 0),
+		offset:   nullInt64Or(wm.offset, 0),
+	}
+}
+
+func textLayerFromWatermark(wm watermark) markLayer {
+	return markLayer{
+		kind:     layerTypeText,
+		source:   wm.text.String,
+		font:     wm.textFont.String,
+		color:    nullStringOr(wm.textColor, defaultTextColor),
+		position: nullStringOr(wm.textPosition, defaultTextPosition),
+		size:     nullInt64Or(wm.textSize, defaultTextSize),
+		alpha:    nullInt64Or(wm.textAlpha, defaultTextAlpha),
+		offset:   defaultTextOffset,
+	}
+}
+
+// override replaces the resolved values with any set in the config layer
+func (m markLayer) override(l WatermarkLayer) markLayer {
+	if len(l.Logo) > 0 && m.kind == layerTypeLogo {
+		m.source = l.Logo
+	}
+	if len(l.Text) > 0 && m.kind == layerTypeText {
+		m.source = l.Text
+	}
+	if len(l.Font) > 0 {
+		m.font = l.Font
+	}
+	if len(l.Color) > 0 {
+		m.color = l.Color
+	}
+	if len(l.Position) > 0 {
+		m.position = l.Position
+	}
+	if l.Size != 0 {
+		m.size = l.Size
+	}
+	if l.Alpha != 0 {
+		m.alpha = l.Alpha
+	}
+	if l.Scale != 0 {
+		m.scale = l.Scale
+	}
+	if l.Offset != 0 {
+		m.offset = l.Offset
+	}
+
+	return m
+}
+
+// addParams adds this layer's Imagizer params to vals using prefix, e.g.
+// "mark" for the first logo layer or "text2" for the second text layer
+func (m markLayer) addParams(vals url.Values, prefix string) {
+	vals.Add(prefix, m.source)
+
+	switch m.kind {
+	case layerTypeLogo:
+		vals.Add(prefix+"_scale", strconv.FormatInt(m.scale, 10))
+	case layerTypeText:
+		if len(m.font) > 0 {
+			vals.Add(prefix+"_font", m.font)
+		}
+		vals.Add(prefix+"_size", strconv.FormatInt(m.size, 10))
+		vals.Add(prefix+"_color", m.color)
+	}
+
+	vals.Add(prefix+"_offset", strconv.FormatInt(m.offset, 10))
+	vals.Add(prefix+"_alpha", strconv.FormatInt(m.alpha, 10))
+	vals.Add(prefix+"_pos", m.position)
+}
+
+// addWatermarkLayerParams adds the params for every layer in order. The first
+// layer of each kind uses the plain Imagizer prefix and later layers of the
+// same kind are numbered from 2.
+func addWatermarkLayerParams(vals url.Values, layers []markLayer) {
+	counts := map[string]int{}
+
+	for _, layer := range layers {
+		if len(layer.source) == 0 {
+			continue
+		}
+
+		var prefix string
+		switch layer.kind {
+		case layerTypeLogo:
+			prefix = logoParamPrefix
+		case layerTypeText:
+			prefix = textParamPrefix
+		default:
+			continue
+		}
+
+		counts[layer.kind]++
+		if n := counts[layer.kind]; n > 1 {
+			prefix = fmt.Sprintf("%s%d", prefix, n)
+		}
+
+		layer.addParams(vals, prefix)
+	}
+}
+
+// watermarkLayers resolves the layers to compose onto the requested picture.
+// Versions with configured layers use those, otherwise the photographer's
+// watermark from the DB supplies a logo and/or text credit.
+func (h imagizerHandler) watermarkLayers(rinfo requestInfo) []markLayer {
+	wm := rinfo.info.mark
+	logo := logoLayerFromWatermark(h.getCanonicalWatermark(rinfo))
+	text := textLayerFromWatermark(wm)
+
+	configured, _ := rinfo.versionInfo["watermark_layers"].([]WatermarkLayer)
+	if len(configured) == 0 {
+		var layers []markLayer
+
+		if wm.logo.Valid || !wm.text.Valid {
+			layers = append(layers, logo)
+		}
+		if wm.text.Valid {
+			layers = append(layers, text)
+		}
+
+		return layers
+	}
+
+	layers := make([]markLayer, 0, len(configured))
+	for _, l := range configured {
+		switch l.Type {
+		case layerTypeLogo:
+			layers = append(layers, logo.override(l))
+		case layerTypeText:
+			layers = append(layers, text.override(l))
+		}
+	}
+
+	return layers
+}
+
+// applyWatermarkMode repositions the resolved layers for the version's mode.
+// Imagizer can only place a mark once, so tiled logos are swapped for an
+// overlay ibex renders and stretched over the whole picture. Text can't be
+// tiled and is centered instead.
+func (h imagizerHandler) applyWatermarkMode(mode string, layers []markLayer) []markLayer {
+	if mode == "" || mode == watermarkModeCorner {
+		return layers
+	}
+
+	out := make([]markLayer, len(layers))
+	for i, layer := range layers {
+		layer.position = "center"
+		layer.offset = 0
+
+		switch {
+		case mode == watermarkModeTiled && layer.kind == layerTypeLogo:
+			layer.source = tiledOverlayURL(h.config.OverlayHost, h.config.OverlaySecret, layer.source, layer.scale)
+			layer.scale = 100
+		case layer.kind == layerTypeLogo && layer.scale < centeredMinScale:
+			layer.scale = centeredMinScale
+		}
+
+		out[i] = layer
+	}
+
+	return out
+}
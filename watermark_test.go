@@ -0,0 +1,205 @@
+/* Copyright 2016 Snapshots LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func watermarkTestHandler() imagizerHandler {
+	imagizerHost, _ := url.Parse("http://imagizer.test")
+	return imagizerHandler{imagizerHost: imagizerHost, config: load(), logger: testLogger{}}
+}
+
+func textMark() watermark {
+	return watermark{
+		id:           newNullInt64(6),
+		disabled:     newNullBool(false),
+		text:         newNullString("Photo by Test Photographer"),
+		textSize:     newNullInt64(32),
+		textColor:    newNullString("000000"),
+		textAlpha:    newNullInt64(50),
+		textPosition: newNullString("bottom,right"),
+	}
+}
+
+func TestWatermarkLayerValidation(t *testing.T) {
+	Convey("Watermark layer types", t, func() {
+		So(WatermarkLayer{Type: "logo"}.validate(), ShouldBeNil)
+		So(WatermarkLayer{Type: "text"}.validate(), ShouldBeNil)
+		So(WatermarkLayer{Type: "sparkles"}.validate(), ShouldNotBeNil)
+	})
+}
+
+func TestWatermarkLayers(t *testing.T) {
+	Convey("Resolving watermark layers", t, func() {
+		handler := watermarkTestHandler()
+		rinfo := requestInfo{
+			pictureID:   1,
+			env:         "staging",
+			versionInfo: map[string]interface{}{"watermark": true},
+		}
+
+		Convey("Falls back to the default logo without a watermark", func() {
+			layers := handler.watermarkLayers(rinfo)
+
+			So(len(layers), ShouldEqual, 1)
+			So(layers[0].kind, ShouldEqual, layerTypeLogo)
+			So(layers[0].source, ShouldEqual, defaultWatermarkLogo)
+		})
+
+		Convey("Uses only the text credit for a text-only watermark", func() {
+			rinfo.info.mark = textMark()
+			layers := handler.watermarkLayers(rinfo)
+
+			So(len(layers), ShouldEqual, 1)
+			So(layers[0].kind, ShouldEqual, layerTypeText)
+			So(layers[0].source, ShouldEqual, "Photo by Test Photographer")
+			So(layers[0].size, ShouldEqual, 32)
+		})
+
+		Convey("Composes configured layers over the DB watermark", func() {
+			rinfo.info.mark = textMark()
+			rinfo.versionInfo["watermark_layers"] = []WatermarkLayer{
+				{Type: "logo", Alpha: 30},
+				{Type: "text", Color: "ff0000"},
+				{Type: "text", Text: "Proof", Position: "center"},
+			}
+			layers := handler.watermarkLayers(rinfo)
+
+			So(len(layers), ShouldEqual, 3)
+			So(layers[0].alpha, ShouldEqual, 30)
+			So(layers[1].source, ShouldEqual, "Photo by Test Photographer")
+			So(layers[1].color, ShouldEqual, "ff0000")
+			So(layers[2].source, ShouldEqual, "Proof")
+			So(layers[2].position, ShouldEqual, "center")
+
+			vals := url.Values{}
+			addWatermarkLayerParams(vals, layers)
+
+			So(vals.Get("mark_alpha"), ShouldEqual, "30")
+			So(vals.Get("text"), ShouldEqual, "Photo by Test Photographer")
+			So(vals.Get("text_color"), ShouldEqual, "ff0000")
+			So(vals.Get("text2"), ShouldEqual, "Proof")
+			So(vals.Get("text2_pos"), ShouldEqual, "center")
+		})
+	})
+}
+
+func TestImagizerURLWatermarkParams(t *testing.T) {
+	Convey("Imagizer URL for a watermarked version", t, func() {
+		handler := watermarkTestHandler()
+		rinfo := requestInfo{
+			pictureID:   3,
+			env:         "staging",
+			versionInfo: handler.config.versionsByName["thumb_watermarked"],
+			info:        pictureInfo{userID: 1, ownerID: 1, attachment: "pic.jpg", mark: textMark()},
+		}
+
+		u, err := handler.imagizerURL(context.Background(), rinfo)
+		So(err, ShouldBeNil)
+
+		q := u.Query()
+		So(q.Get("text"), ShouldEqual, "Photo by Test Photographer")
+		So(q.Get("text_pos"), ShouldEqual, "bottom,right")
+		So(q.Get("mark"), ShouldBeEmpty)
+		So(q.Get("width"), ShouldEqual, "360")
+
+		Convey("Guest uploads are not marked", func() {
+			rinfo.info.userID = 2
+			u, err := handler.imagizerURL(context.Background(), rinfo)
+			So(err, ShouldBeNil)
+			So(u.Query().Get("text"), ShouldBeEmpty)
+		})
+
+		Convey("Guest uploads are marked when the policy allows it", func() {
+			rinfo.info.userID = 2
+			rinfo.versionInfo = map[string]interface{}{"watermark": true, "watermark_policy": policyEveryone}
+			u, err := handler.imagizerURL(context.Background(), rinfo)
+			So(err, ShouldBeNil)
+			So(u.Query().Get("text"), ShouldEqual, "Photo by Test Photographer")
+		})
+	})
+}
+
+func TestWatermarkModes(t *testing.T) {
+	Convey("Applying watermark modes", t, func() {
+		handler := watermarkTestHandler()
+		handler.config.OverlayHost = "http://ibex.test"
+		handler.config.OverlaySecret = "overlay secret"
+		layers := []markLayer{
+			{kind: layerTypeLogo, source: "https://snapshots.test/logo.png", scale: 15, offset: 3, position: "bottom,right"},
+			{kind: layerTypeText, source: "Proof", offset: 3, position: "bottom,left"},
+		}
+
+		So(validateWatermarkMode("tiled"), ShouldBeNil)
+		So(validateWatermarkMode("diagonal"), ShouldNotBeNil)
+		So(handler.applyWatermarkMode("corner", layers), ShouldResemble, layers)
+
+		Convey("Centered", func() {
+			out := handler.applyWatermarkMode(watermarkModeCentered, layers)
+
+			So(out[0].position, ShouldEqual, "center")
+			So(out[0].scale, ShouldEqual, centeredMinScale)
+			So(out[1].position, ShouldEqual, "center")
+			So(out[1].offset, ShouldEqual, 0)
+		})
+
+		Convey("Tiled", func() {
+			out := handler.applyWatermarkMode(watermarkModeTiled, layers)
+
+			So(out[0].source, ShouldEqual, tiledOverlayURL("http://ibex.test", "overlay secret", "https://snapshots.test/logo.png", 15))
+			So(out[0].scale, ShouldEqual, 100)
+			So(out[1].source, ShouldEqual, "Proof")
+			So(out[1].position, ShouldEqual, "center")
+			So(layers[0].position, ShouldEqual, "bottom,right")
+		})
+	})
+}
+
+func TestWatermarkDecision(t *testing.T) {
+	Convey("Watermark policy decisions", t, func() {
+		cases := []struct {
+			policy   string
+			userID   int
+			expected string
+		}{
+			{"", 1, decisionOwner},
+			{"", 2, decisionGuestUnmarked},
+			{policyOwnerOnly, 2, decisionGuestUnmarked},
+			{policyEveryone, 1, decisionOwner},
+			{policyEveryone, 2, decisionGuestOwnMark},
+			{policyGuestDefaultMark, 2, decisionGuestDefaultMark},
+			{policyGuestOwnerMark, 2, decisionGuestOwnerMark},
+		}
+
+		for _, c := range cases {
+			rinfo := requestInfo{
+				versionInfo: map[string]interface{}{"watermark": true, "watermark_policy": c.policy},
+				info:        pictureInfo{userID: c.userID, ownerID: 1},
+			}
+
+			So(rinfo.watermarkDecision(), ShouldEqual, c.expected)
+		}
+
+		So(validateWatermarkPolicy(policyGuestOwnerMark), ShouldBeNil)
+		So(validateWatermarkPolicy("guests"), ShouldNotBeNil)
+	})
+}